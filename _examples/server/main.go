@@ -7,7 +7,6 @@ import (
 	"github.com/gin-gonic/autotls"
 	"github.com/gin-gonic/gin"
 	"gorm.io/driver/sqlite"
-	"image"
 	"log"
 	"mime/multipart"
 	"net/http"
@@ -77,7 +76,7 @@ func addImage(c *gin.Context) {
 		validationError(c, err)
 		return
 	}
-	_, err := imgidx.AddImageUrl(idx, req.Url, req.Attributes)
+	_, err := imgidx.AddImageUrlContext(c.Request.Context(), idx, req.Url, req.Attributes)
 	if err != nil {
 		validationError(c, err)
 		return
@@ -97,7 +96,7 @@ func findByURL(c *gin.Context) {
 		validationError(c, err)
 		return
 	}
-	nearestImgUrl, attrs, dist, err := imgidx.NearestByURL(idx, imgUrl)
+	nearestImgUrl, attrs, dist, err := imgidx.NearestByURLContext(c.Request.Context(), idx, imgUrl)
 	if err != nil {
 		validationError(c, err)
 		return
@@ -130,14 +129,7 @@ func findByFile(c *gin.Context) {
 			log.Printf("Failed to close file from HTTP request: %v", err)
 		}
 	}(f)
-	queryImg, _, err := image.Decode(f)
-	if err != nil {
-		validationError(c, fmt.Errorf("failed to decode image %w", err))
-		return
-	}
-
-	nearestImgUrl, attrs, dist, err := idx.Nearest(queryImg)
-
+	nearestImgUrl, attrs, dist, err := imgidx.NearestByReaderContext(c.Request.Context(), idx, f)
 	if err != nil {
 		validationError(c, fmt.Errorf("failed to find similar image : %w", err))
 		return
@@ -155,6 +147,11 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// The server downloads images by URLs passed by users, so it must not be able to reach internal services
+	imgidx.DefaultFetcher, err = imgidx.NewFetcher(imgidx.WithPrivateAddressesBlocked())
+	if err != nil {
+		log.Fatal(err)
+	}
 	token = os.Getenv("AUTH_TOKEN")
 	initAndRunWebServer()
 }
@@ -0,0 +1,120 @@
+package imgidx
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/alef-ru/imgidx/embedders"
+	"image"
+	"io"
+)
+
+// DecodeLimits limits the images DecodeImage accepts. Zero fields mean no limit.
+type DecodeLimits struct {
+	// MaxBytes is the maximum size of the encoded image in bytes
+	MaxBytes int64
+	// MaxWidth and MaxHeight are the maximum dimensions of the image in pixels
+	MaxWidth, MaxHeight int
+	// MaxPixels is the maximum number of pixels in the image, it limits the memory taken by the decoded image
+	MaxPixels int
+}
+
+// DecodeOptions tell how DecodeImage decodes the images.
+type DecodeOptions struct {
+	// AutoOrient makes the JPEG images with the EXIF orientation tag flipped and rotated to be upright,
+	// the way browsers and image viewers display them. Otherwise, a photo uploaded from different clients,
+	// which rotate the pixels or set the tag, produces different vectors.
+	//
+	// It changes the vectors of the images with the tag, so they no longer match the ones added to an index
+	// without it. The images of an existing index are to be added again once it's turned on.
+	AutoOrient bool
+}
+
+// DefaultDecodeLimits are used by the helpers that read images from files, and by the Fetchers without
+// limit options, including DefaultFetcher. They may be changed to apply other limits, which takes effect
+// on the next image they read.
+var DefaultDecodeLimits = DecodeLimits{
+	MaxBytes:  32 << 20,
+	MaxWidth:  10000,
+	MaxHeight: 10000,
+	MaxPixels: 50_000_000,
+}
+
+// DefaultDecodeOptions are used by the helpers that read images from files and readers, and by the Fetchers
+// without the WithDecodeOptions option, including DefaultFetcher. AutoOrient is off by default, so that
+// the vectors of the images stay the same as in the indexes built before it was added.
+var DefaultDecodeOptions = DecodeOptions{}
+
+// DecodeImage decodes the image with the options, rejecting it with ErrImageTooLarge if it exceeds the limits.
+//
+// The dimensions are read from the image header before the image is decoded, so an image that declares
+// huge dimensions in a few bytes doesn't exhaust the memory.
+func DecodeImage(r io.Reader, limits DecodeLimits, opts DecodeOptions) (image.Image, error) {
+	if limits.MaxBytes > 0 {
+		lr := &limitedReader{r: r, limit: limits.MaxBytes}
+		img, err := decodeImage(lr, limits, opts)
+		if lr.exceeded {
+			return nil, fmt.Errorf("%w: more than %d bytes", ErrImageTooLarge, limits.MaxBytes)
+		}
+		return img, err
+	}
+	return decodeImage(r, limits, opts)
+}
+
+func decodeImage(r io.Reader, limits DecodeLimits, opts DecodeOptions) (image.Image, error) {
+	// The header read by DecodeConfig is kept, so the image is decoded without reading the input again
+	var header bytes.Buffer
+	cfg, format, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if err := limits.check(cfg); err != nil {
+		return nil, err
+	}
+	// The header is consumed by decoding, the orientation is read before
+	orientation := 1
+	if opts.AutoOrient && format == "jpeg" {
+		orientation = jpegOrientation(header.Bytes())
+	}
+	img, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	if orientation != 1 {
+		return embedders.Orient(img, orientation)
+	}
+	return img, nil
+}
+
+func (l DecodeLimits) check(cfg image.Config) error {
+	if (l.MaxWidth > 0 && cfg.Width > l.MaxWidth) || (l.MaxHeight > 0 && cfg.Height > l.MaxHeight) ||
+		(l.MaxPixels > 0 && int64(cfg.Width)*int64(cfg.Height) > int64(l.MaxPixels)) {
+		return fmt.Errorf("%w: %dx%d pixels", ErrImageTooLarge, cfg.Width, cfg.Height)
+	}
+	return nil
+}
+
+// limitedReader reads from r until more than limit bytes are read.
+// Decoders may not return the reader's errors as is, so exceeding the limit is recorded in the exceeded field.
+type limitedReader struct {
+	r        io.Reader
+	limit    int64
+	read     int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, ErrImageTooLarge
+	}
+	// One byte more than the limit is requested to tell if the input exceeds it
+	if left := l.limit - l.read + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		l.exceeded = true
+		return 0, ErrImageTooLarge
+	}
+	return n, err
+}
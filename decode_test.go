@@ -0,0 +1,173 @@
+package imgidx_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/alef-ru/imgidx"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pngBomb returns a tiny PNG image that declares the given dimensions in its header
+func pngBomb(t *testing.T, width, height uint32) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))))
+	data := buf.Bytes()
+	// The IHDR chunk follows the 8-byte signature: length, type, width, height, ... and CRC of type and data
+	const ihdr = 8
+	binary.BigEndian.PutUint32(data[ihdr+8:], width)
+	binary.BigEndian.PutUint32(data[ihdr+12:], height)
+	binary.BigEndian.PutUint32(data[ihdr+8+13:], crc32.ChecksumIEEE(data[ihdr+4:ihdr+8+13]))
+	return data
+}
+
+func TestDecodeImage(t *testing.T) {
+	data, err := os.ReadFile("testdata/pokemon/abra.png")
+	assert.NoError(t, err)
+	img, err := imgidx.DecodeImage(bytes.NewReader(data), imgidx.DefaultDecodeLimits, imgidx.DecodeOptions{})
+	assert.NoError(t, err)
+	expected, err := loadImage("testdata/pokemon/abra.png")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, img)
+
+	_, err = imgidx.DecodeImage(bytes.NewReader(data), imgidx.DecodeLimits{MaxBytes: int64(len(data)) - 1},
+		imgidx.DecodeOptions{})
+	assert.ErrorIs(t, err, imgidx.ErrImageTooLarge)
+	_, err = imgidx.DecodeImage(bytes.NewReader(data), imgidx.DecodeLimits{MaxBytes: int64(len(data))},
+		imgidx.DecodeOptions{})
+	assert.NoError(t, err)
+
+	bounds := expected.Bounds()
+	_, err = imgidx.DecodeImage(bytes.NewReader(data), imgidx.DecodeLimits{MaxPixels: bounds.Dx()*bounds.Dy() - 1},
+		imgidx.DecodeOptions{})
+	assert.ErrorIs(t, err, imgidx.ErrImageTooLarge)
+	_, err = imgidx.DecodeImage(bytes.NewReader(data), imgidx.DecodeLimits{MaxWidth: bounds.Dx() - 1},
+		imgidx.DecodeOptions{})
+	assert.ErrorIs(t, err, imgidx.ErrImageTooLarge)
+}
+
+func TestDecodeImageBomb(t *testing.T) {
+	bomb := pngBomb(t, 100000, 100000)
+	_, err := imgidx.DecodeImage(bytes.NewReader(bomb), imgidx.DefaultDecodeLimits, imgidx.DecodeOptions{})
+	assert.ErrorIs(t, err, imgidx.ErrImageTooLarge)
+	assert.ErrorContains(t, err, "100000x100000 pixels")
+
+	// The file helpers use the same limits
+	path := filepath.Join(t.TempDir(), "bomb.png")
+	assert.NoError(t, os.WriteFile(path, bomb, 0o600))
+	_, _, _, err = imgidx.NearestByFile(newKD3Index(t), path)
+	assert.ErrorIs(t, err, imgidx.ErrImageTooLarge)
+}
+
+// jpegWithOrientation returns the JPEG image with an EXIF segment with the orientation tag,
+// encoded with the given byte order
+func jpegWithOrientation(t *testing.T, img image.Image, orientation uint16, order binary.ByteOrder) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}))
+	data := buf.Bytes()
+
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8) // the first IFD follows the header
+	order.PutUint16(tiff[8:], 1) // a single entry
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3) // SHORT
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	res := []byte{0xff, 0xd8, 0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(res[4:], uint16(len(segment)+2))
+	res = append(res, segment...)
+	return append(res, data[2:]...) // the SOI marker is already written
+}
+
+func TestDecodeImageOrientation(t *testing.T) {
+	// A red image with a blue square in the top left corner
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x < 16 && y < 16 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	isBlue := func(c color.Color) bool {
+		r, _, b, _ := c.RGBA()
+		return b > 0xc000 && r < 0x4000
+	}
+	for _, tc := range []struct {
+		orientation uint16
+		order       binary.ByteOrder
+		size        image.Point
+		corner      image.Point // where the blue square gets
+	}{
+		{1, binary.LittleEndian, image.Pt(64, 32), image.Pt(0, 0)},
+		{2, binary.BigEndian, image.Pt(64, 32), image.Pt(63, 0)},
+		{3, binary.LittleEndian, image.Pt(64, 32), image.Pt(63, 31)},
+		{4, binary.BigEndian, image.Pt(64, 32), image.Pt(0, 31)},
+		{5, binary.LittleEndian, image.Pt(32, 64), image.Pt(0, 0)},
+		{6, binary.BigEndian, image.Pt(32, 64), image.Pt(31, 0)},
+		{7, binary.LittleEndian, image.Pt(32, 64), image.Pt(31, 63)},
+		{8, binary.BigEndian, image.Pt(32, 64), image.Pt(0, 63)},
+		{42, binary.BigEndian, image.Pt(64, 32), image.Pt(0, 0)}, // invalid values are ignored
+	} {
+		data := jpegWithOrientation(t, img, tc.orientation, tc.order)
+		res, err := imgidx.DecodeImage(bytes.NewReader(data), imgidx.DefaultDecodeLimits,
+			imgidx.DecodeOptions{AutoOrient: true})
+		assert.NoError(t, err)
+		assert.Equal(t, tc.size, res.Bounds().Size(), "orientation %d", tc.orientation)
+		assert.True(t, isBlue(res.At(tc.corner.X, tc.corner.Y)), "orientation %d", tc.orientation)
+
+		// The option is off by default
+		res, err = imgidx.DecodeImage(bytes.NewReader(data), imgidx.DefaultDecodeLimits, imgidx.DefaultDecodeOptions)
+		assert.NoError(t, err)
+		assert.Equal(t, image.Pt(64, 32), res.Bounds().Size())
+		assert.True(t, isBlue(res.At(0, 0)))
+	}
+}
+
+func TestNearestByFileOrientation(t *testing.T) {
+	// A photo rotated by the camera with the EXIF tag matches the one rotated by the pixels
+	img, err := loadImage("testdata/pokemon/abomasnow.png")
+	assert.NoError(t, err)
+	b := img.Bounds()
+	rotated := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			rotated.Set(b.Max.Y-1-y, x-b.Min.X, img.At(x, y))
+		}
+	}
+	idx := newKD3Index(t)
+	_, err = idx.AddImage(rotated, "rotated", nil)
+	assert.NoError(t, err)
+	_, err = idx.AddImage(img, "original", nil)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "tagged.jpg")
+	assert.NoError(t, os.WriteFile(path, jpegWithOrientation(t, img, 6, binary.LittleEndian), 0o600))
+	uri, _, _, err := imgidx.NearestByFile(idx, path)
+	assert.NoError(t, err)
+	assert.Equal(t, "original", uri, "the tag is ignored by default")
+
+	opts := imgidx.DefaultDecodeOptions
+	t.Cleanup(func() { imgidx.DefaultDecodeOptions = opts })
+	imgidx.DefaultDecodeOptions.AutoOrient = true
+	uri, _, _, err = imgidx.NearestByFile(idx, path)
+	assert.NoError(t, err)
+	assert.Equal(t, "rotated", uri)
+}
@@ -0,0 +1,209 @@
+package imgidx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultImageExtensions are the extensions of the files AddImageDir indexes by default, the supported formats
+var defaultImageExtensions = []string{".jpg", ".jpeg", ".png", ".gif"}
+
+// DirOptions configures AddImageDir. The zero value indexes the files of all the supported formats.
+type DirOptions struct {
+	// Extensions are the extensions of the files to index, such as ".jpg". They are case-insensitive.
+	// If empty, the extensions of the supported formats are used.
+	Extensions []string
+	// Pattern is a glob pattern, as accepted by filepath.Match, that the file names must match. Empty matches any name.
+	Pattern string
+	// Workers is the number of files read and embedded in parallel. If not positive, a worker per CPU is used.
+	Workers int
+	// Attributes returns the attributes of the image read from the file. If nil, the images have no attributes.
+	Attributes func(path string) interface{}
+}
+
+// DirResult is the outcome of AddImageDir. The URIs and errors are sorted by path.
+type DirResult struct {
+	// Added are the URIs of the added images
+	Added []string
+	// Skipped are the URIs of the images that were already in the index
+	Skipped []string
+	// Errors are the errors of the files that failed to be read or added
+	Errors []FileError
+}
+
+// FileError is an error of a single file processed by AddImageDir
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e FileError) Error() string { return fmt.Sprintf("%s: %v", e.Path, e.Err) }
+
+func (e FileError) Unwrap() error { return e.Err }
+
+// AddImageDir walks the directory tree rooted at root and adds the images to the index,
+// using the same URIs as AddImageFile does.
+//
+// The files are read and embedded by a pool of workers. The images that are already in the index are skipped.
+// A file that fails to be read or added doesn't stop the rest of them, its error is reported in the result.
+// The returned error is only set if root can't be read or ctx is done, the result contains the files
+// processed until then.
+func AddImageDir(ctx context.Context, idx Index, root string, opts DirOptions) (DirResult, error) {
+	if _, err := filepath.Match(opts.Pattern, ""); err != nil {
+		return DirResult{}, fmt.Errorf("invalid pattern %q: %w", opts.Pattern, err)
+	}
+	var (
+		res  DirResult
+		lock sync.Mutex
+		wg   sync.WaitGroup
+	)
+	fail := func(path string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		res.Errors = append(res.Errors, FileError{Path: path, Err: err})
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	paths := make(chan string)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				uri, added, err := addDirFile(ctx, idx, path, opts)
+				if err != nil {
+					if ctx.Err() == nil { // cancellation is reported by AddImageDir itself
+						fail(path, err)
+					}
+					continue
+				}
+				lock.Lock()
+				if added {
+					res.Added = append(res.Added, uri)
+				} else {
+					res.Skipped = append(res.Skipped, uri)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			// The unreadable directory is skipped
+			fail(path, err)
+			return nil
+		}
+		if d.IsDir() || !opts.matches(d.Name()) {
+			return nil
+		}
+		select {
+		case paths <- path:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(paths)
+	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	sort.Strings(res.Added)
+	sort.Strings(res.Skipped)
+	sort.Slice(res.Errors, func(i, j int) bool { return res.Errors[i].Path < res.Errors[j].Path })
+	return res, err
+}
+
+// addDirFile adds the image from the file to the index unless it's already there
+func addDirFile(ctx context.Context, idx Index, path string, opts DirOptions) (uri string, added bool, err error) {
+	uri, err = fileURI(path)
+	if err != nil {
+		return "", false, err
+	}
+	if idx.Contains(uri) {
+		return uri, false, nil
+	}
+	// The earlier versions of AddImageFile didn't escape the URIs, the images they added are skipped too
+	if legacy, err := legacyFileURI(path); err == nil && legacy != uri && idx.Contains(legacy) {
+		return legacy, false, nil
+	}
+	img, err := readImageFile(path)
+	if err != nil {
+		return "", false, err
+	}
+	var attrs interface{}
+	if opts.Attributes != nil {
+		attrs = opts.Attributes(path)
+	}
+	_, err = idx.AddImageContext(ctx, img, uri, attrs)
+	if errors.Is(err, URIAlreadyExists{}) { // added concurrently
+		return uri, false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return uri, true, nil
+}
+
+// matches reports whether the file with the name is to be indexed
+func (opts DirOptions) matches(name string) bool {
+	extensions := opts.Extensions
+	if len(extensions) == 0 {
+		extensions = defaultImageExtensions
+	}
+	ext := filepath.Ext(name)
+	found := false
+	for _, e := range extensions {
+		if strings.EqualFold(ext, e) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	if opts.Pattern == "" {
+		return true
+	}
+	ok, err := filepath.Match(opts.Pattern, name)
+	return err == nil && ok
+}
+
+// fileURI returns the file:// URI of the file with the path, which is either absolute or relative to
+// the working directory. The characters that have special meaning in URIs, such as '#' and '%', are escaped.
+func fileURI(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path of %s: %w", path, err)
+	}
+	abs = filepath.ToSlash(abs)
+	if !strings.HasPrefix(abs, "/") { // Windows paths start with a drive letter
+		abs = "/" + abs
+	}
+	return (&url.URL{Scheme: "file", Path: abs}).String(), nil
+}
+
+// legacyFileURI returns the URI the earlier versions of AddImageFile made of the relative path:
+// file:// followed by the unescaped absolute path
+func legacyFileURI(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path of %s: %w", path, err)
+	}
+	return "file://" + abs, nil
+}
@@ -0,0 +1,138 @@
+package imgidx_test
+
+import (
+	"context"
+	"github.com/alef-ru/imgidx"
+	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeImageDir makes a directory tree of images and some other files, and returns its path
+func makeImageDir(t *testing.T) string {
+	root := t.TempDir()
+	files := map[string]string{
+		"abra.png":               "testdata/pokemon/abra.png",
+		"nested/absol.png":       "testdata/pokemon/absol.png",
+		"nested/deeper/ABRA.PNG": "testdata/pokemon/abra.png",
+		"nested/abomasnow.jpg":   "testdata/compressed_abomasnow.jpg",
+	}
+	for name, src := range files {
+		data, err := os.ReadFile(src)
+		assert.NoError(t, err)
+		path := filepath.Join(root, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, data, 0o600))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "nested", "broken.png"), []byte("not an image"), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(root, "notes.txt"), []byte("not an image"), 0o600))
+	return root
+}
+
+func TestAddImageDir(t *testing.T) {
+	root := makeImageDir(t)
+	uri := func(name string) string { return "file://" + filepath.ToSlash(filepath.Join(root, name)) }
+	idx := newKD3Index(t)
+
+	res, err := imgidx.AddImageDir(context.Background(), idx, root, imgidx.DirOptions{
+		Workers:    2,
+		Attributes: func(path string) interface{} { return filepath.Base(path) },
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{uri("abra.png"), uri("nested/abomasnow.jpg"), uri("nested/absol.png"),
+		uri("nested/deeper/ABRA.PNG")}, res.Added)
+	assert.Empty(t, res.Skipped)
+	assert.Equal(t, 1, len(res.Errors))
+	assert.Equal(t, filepath.Join(root, "nested", "broken.png"), res.Errors[0].Path)
+	assert.ErrorContains(t, res.Errors[0], "image: unknown format")
+	assert.Equal(t, 4, idx.GetCount())
+	_, attrs, ok := idx.Get(uri("nested/absol.png"))
+	assert.True(t, ok)
+	assert.Equal(t, "absol.png", attrs)
+
+	// The images added before are skipped, the same URIs are used as by AddImageFile
+	_, err = imgidx.AddImageFile(idx, "testdata/pokemon/abomasnow.png", nil)
+	assert.NoError(t, err)
+	res, err = imgidx.AddImageDir(context.Background(), idx, root, imgidx.DirOptions{Extensions: []string{".png"}})
+	assert.NoError(t, err)
+	assert.Empty(t, res.Added)
+	assert.Equal(t, []string{uri("abra.png"), uri("nested/absol.png"), uri("nested/deeper/ABRA.PNG")}, res.Skipped)
+}
+
+func TestAddImageDirPattern(t *testing.T) {
+	root := makeImageDir(t)
+	idx := newKD3Index(t)
+	res, err := imgidx.AddImageDir(context.Background(), idx, root, imgidx.DirOptions{Pattern: "a*"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(res.Added))
+	assert.Empty(t, res.Errors)
+
+	_, err = imgidx.AddImageDir(context.Background(), idx, root, imgidx.DirOptions{Pattern: "["})
+	assert.ErrorIs(t, err, filepath.ErrBadPattern)
+	_, err = imgidx.AddImageDir(context.Background(), idx, filepath.Join(root, "missing"), imgidx.DirOptions{})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestAddImageDirCancelled(t *testing.T) {
+	root := makeImageDir(t)
+	idx := newKD3Index(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, err := imgidx.AddImageDir(ctx, idx, root, imgidx.DirOptions{})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, res.Added)
+	assert.Equal(t, 0, idx.GetCount())
+}
+
+func TestAddImageDirEscapedURIs(t *testing.T) {
+	root := t.TempDir()
+	data, err := os.ReadFile("testdata/pokemon/abra.png")
+	assert.NoError(t, err)
+	for _, name := range []string{"a#b.png", "100%.png", "with space/c?d.png"} {
+		path := filepath.Join(root, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, data, 0o600))
+	}
+	idx := newKD3Index(t)
+	res, err := imgidx.AddImageDir(context.Background(), idx, root, imgidx.DirOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, res.Errors)
+	prefix := "file://" + filepath.ToSlash(root)
+	assert.Equal(t, []string{prefix + "/100%25.png", prefix + "/a%23b.png", prefix + "/with%20space/c%3Fd.png"},
+		res.Added)
+	for _, uri := range res.Added {
+		u, err := url.Parse(uri)
+		assert.NoError(t, err)
+		assert.Empty(t, u.Fragment, uri)
+		assert.Empty(t, u.RawQuery, uri)
+		_, err = os.Stat(filepath.FromSlash(u.Path))
+		assert.NoError(t, err, "%s doesn't point at the file", uri)
+	}
+
+	// AddImageFile makes the same URIs
+	_, err = imgidx.AddImageFile(idx, filepath.Join(root, "a#b.png"), nil)
+	assert.ErrorIs(t, err, imgidx.URIAlreadyExists{})
+
+	// The images added with the unescaped URIs by the earlier versions are skipped
+	legacy := newKD3Index(t)
+	vec := make(embedders.Vector, newEmbedder().Dims())
+	legacyURI := "file://" + filepath.Join(root, "with space", "c?d.png")
+	assert.NoError(t, legacy.AddVector(vec, legacyURI, nil))
+	res, err = imgidx.AddImageDir(context.Background(), legacy, root, imgidx.DirOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{prefix + "/100%25.png", prefix + "/a%23b.png"}, res.Added)
+	assert.Equal(t, []string{legacyURI}, res.Skipped)
+	assert.Equal(t, 3, legacy.GetCount())
+}
+
+func TestAddImageFileAbsolutePath(t *testing.T) {
+	path, err := filepath.Abs("testdata/pokemon/abra.png")
+	assert.NoError(t, err)
+	idx := newKD3Index(t)
+	_, err = imgidx.AddImageFile(idx, path, nil)
+	assert.NoError(t, err)
+	assert.True(t, idx.Contains("file://"+filepath.ToSlash(path)))
+}
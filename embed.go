@@ -11,6 +11,8 @@ type ImgEmbed struct {
 	Vector     kdtree.Point `gorm:"serializer:json"`
 	Attributes interface{}  `gorm:"serializer:json"`
 	_          struct{}     `gorm:"-"`
+	// seq tells apart the images with the same URI in the kd-tree, when one of them is a tombstone
+	seq uint64
 }
 
 func (embd ImgEmbed) Compare(c kdtree.Comparable, d kdtree.Dim) float64 {
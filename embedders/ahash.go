@@ -0,0 +1,51 @@
+package embedders
+
+import (
+	"fmt"
+	"image"
+)
+
+type aHashEmbedder struct {
+	HashSize int
+	Alpha    AlphaPolicy
+}
+
+// NewAHashEmbedder returns an embedder that calculates an average hash of an image.
+//
+// The image is converted to grayscale and downsampled to a hashSize*hashSize thumbnail,
+// each pixel of which is compared to the mean of them all.
+// It produces vectors of hashSize*hashSize numbers, 1 for the pixels brighter than the mean and 0 for the rest,
+// so the distance between two vectors is the Hamming distance between the hashes.
+// It's the cheapest of the hash embedders, but it's sensitive to gamma changes.
+// The alpha channel is ignored, so the transparent pixels are black unless the optional policy flattens them.
+func NewAHashEmbedder(hashSize int, policy ...AlphaPolicy) ImageEmbedder {
+	return aHashEmbedder{HashSize: hashSize, Alpha: alphaPolicy(policy)}
+}
+
+func (e aHashEmbedder) Dims() int {
+	return e.HashSize * e.HashSize
+}
+
+func (e aHashEmbedder) Img2Vec(img *image.RGBA) (Vector, error) {
+	return e.embed(pixelsOf(img))
+}
+
+func (e aHashEmbedder) embed(img *pixels) (Vector, error) {
+	return embedRows(e, img)
+}
+
+func (e aHashEmbedder) rowReader(img *pixels) (rowReader, error) {
+	if e.HashSize <= 0 {
+		return nil, fmt.Errorf("aHashEmbedder's HashSize parameter must be greater than 0")
+	}
+	if img.empty() {
+		return nil, ErrEmptyImage
+	}
+	return e.Alpha.reader(newThumbnailReader(img.bounds, e.HashSize, e.HashSize, func(gray []float64) Vector {
+		var sum float64
+		for _, v := range gray {
+			sum += v
+		}
+		return binarize(gray, sum/float64(len(gray)))
+	})), nil
+}
@@ -0,0 +1,34 @@
+package embedders_test
+
+import (
+	"testing"
+
+	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAHashEmbedderImg2Vec(t *testing.T) {
+	// The white and red quadrants are brighter than the mean, the black and the transparent green ones are darker
+	vec, err := embedders.NewAHashEmbedder(2).Img2Vec(createTestImage(100, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, embedders.Vector{1, 0, 0, 0}, vec)
+
+	e := embedders.NewAHashEmbedder(8)
+	assert.Equal(t, 64, e.Dims())
+	vec, err = e.Img2Vec(createTestImage(100, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, e.Dims(), len(vec))
+	assertBinary(t, vec)
+}
+
+func TestAHashEmbedderRobustness(t *testing.T) {
+	assertMatches(t, embedders.NewAHashEmbedder(8), "../testdata/compressed_abomasnow.jpg", 4)
+	assertMatches(t, embedders.NewAHashEmbedder(8), "../testdata/distorted_abomasnow.jpg", 12)
+}
+
+func TestAHashEmbedderErrors(t *testing.T) {
+	_, err := embedders.NewAHashEmbedder(8).Img2Vec(nil)
+	assert.ErrorIs(t, err, embedders.ErrEmptyImage)
+	_, err = embedders.NewAHashEmbedder(0).Img2Vec(createTestImage(10, 10))
+	assert.Error(t, err)
+}
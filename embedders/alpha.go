@@ -0,0 +1,118 @@
+package embedders
+
+import (
+	"image"
+	"image/color"
+)
+
+type alphaMode int
+
+const (
+	keepAlpha alphaMode = iota
+	dropAlpha
+	compositeAlpha
+)
+
+// AlphaPolicy tells how the transparency of images is treated before they are embedded.
+// The embedders that read the colors of the images, and ImageToRGBA, take it as an optional last argument.
+// The zero value is KeepAlpha, which they use if no policy is given.
+//
+// By default, the embedders tell a transparent image from its copy with the transparency flattened, e.g. a PNG image
+// from its JPEG export: the transparent pixels are black, and the low resolution embedder takes the alpha channel
+// as a color component. CompositeAlpha(color.White) makes them match.
+type AlphaPolicy struct {
+	mode       alphaMode
+	background color.Color
+}
+
+var (
+	// KeepAlpha keeps the images as they are
+	KeepAlpha = AlphaPolicy{mode: keepAlpha}
+	// DropAlpha makes the images opaque, keeping the colors of the pixels. The colors of the fully transparent pixels
+	// are unknown once the images are alpha-premultiplied, so they become black.
+	DropAlpha = AlphaPolicy{mode: dropAlpha}
+)
+
+// CompositeAlpha returns the policy that flattens the images onto the background color, the way
+// image editors do when they export a transparent image to a format that doesn't support transparency, e.g. JPEG.
+// CompositeAlpha(color.White) makes a transparent PNG image match its JPEG export. A nil background is white.
+func CompositeAlpha(background color.Color) AlphaPolicy {
+	if background == nil {
+		background = color.White
+	}
+	return AlphaPolicy{mode: compositeAlpha, background: background}
+}
+
+// alphaPolicy returns the last of the optional policies, or KeepAlpha if there are none
+func alphaPolicy(policies []AlphaPolicy) AlphaPolicy {
+	if len(policies) == 0 {
+		return KeepAlpha
+	}
+	return policies[len(policies)-1]
+}
+
+// apply writes the row of alpha-premultiplied pixels to dst with their transparency treated according to the policy.
+// The pixels are composited with the same arithmetic as image/draw uses to draw an *image.RGBA image over another.
+func (p AlphaPolicy) apply(dst, row []uint8) {
+	var bg [4]uint32
+	if p.mode == compositeAlpha {
+		r, g, b, a := p.background.RGBA()
+		bg = [4]uint32{r >> 8, g >> 8, b >> 8, a >> 8}
+	}
+	for i := 0; i < len(row); i += 4 {
+		s := row[i : i+4 : i+4]
+		d := dst[i : i+4 : i+4]
+		switch {
+		case s[3] == 0xff || p.mode == keepAlpha:
+			copy(d, s)
+		case p.mode == dropAlpha:
+			if s[3] == 0 {
+				d[0], d[1], d[2] = 0, 0, 0
+			} else {
+				d[0], d[1], d[2] = unpremultiply(s[0], s[3]), unpremultiply(s[1], s[3]), unpremultiply(s[2], s[3])
+			}
+			d[3] = 0xff
+		default:
+			const m = 0xffff
+			a := (m - uint32(s[3])*0x101) * 0x101
+			for c := range d {
+				d[c] = uint8((bg[c]*a/m + uint32(s[c])*0x101) >> 8)
+			}
+		}
+	}
+}
+
+// reader returns the reader that treats the transparency of the rows according to the policy before r reads them
+func (p AlphaPolicy) reader(r rowReader) rowReader {
+	if p.mode == keepAlpha {
+		return r
+	}
+	return &alphaReader{policy: p, reader: r}
+}
+
+type alphaReader struct {
+	policy AlphaPolicy
+	reader rowReader
+	buf    []uint8
+}
+
+func (a *alphaReader) readRow(y int, row []uint8) {
+	if cap(a.buf) < len(row) {
+		a.buf = make([]uint8, len(row))
+	}
+	buf := a.buf[:len(row)]
+	a.policy.apply(buf, row)
+	a.reader.readRow(y, buf)
+}
+
+func (a *alphaReader) vector() (Vector, error) {
+	return a.reader.vector()
+}
+
+// Preprocess applies the policy to the image, so the policy can be used as a Preprocessor
+func (p AlphaPolicy) Preprocess(img *image.RGBA) (*image.RGBA, error) {
+	if img == nil || img.Bounds().Empty() {
+		return nil, ErrEmptyImage
+	}
+	return ImageToRGBA(img, p), nil
+}
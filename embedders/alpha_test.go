@@ -0,0 +1,141 @@
+package embedders_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
+)
+
+// cutOutBackground returns a copy of the image with its white background made transparent
+func cutOutBackground(img *image.RGBA) *image.NRGBA {
+	b := img.Bounds()
+	res := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			nc := color.NRGBA{R: c.R, G: c.G, B: c.B, A: 0xff}
+			if c.R > 0xf0 && c.G > 0xf0 && c.B > 0xf0 {
+				nc.A = 0
+			}
+			res.SetNRGBA(x-b.Min.X, y-b.Min.Y, nc)
+		}
+	}
+	return res
+}
+
+func TestImageToRGBAAlphaPolicy(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 200, G: 100, B: 50, A: 0xff})
+	img.SetNRGBA(1, 0, color.NRGBA{R: 200, G: 100, B: 50, A: 51})
+	img.SetNRGBA(2, 0, color.NRGBA{R: 200, G: 100, B: 50, A: 0})
+
+	rgba := embedders.ImageToRGBA(img, embedders.KeepAlpha)
+	assert.Equal(t, embedders.ImageToRGBA(img), rgba)
+	assert.Equal(t, color.RGBA{R: 40, G: 20, B: 10, A: 51}, rgba.RGBAAt(1, 0))
+
+	// The colors of the fully transparent pixels are lost once the image is alpha-premultiplied
+	rgba = embedders.ImageToRGBA(img, embedders.DropAlpha)
+	assert.Equal(t, color.RGBA{R: 200, G: 100, B: 50, A: 0xff}, rgba.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{R: 200, G: 100, B: 50, A: 0xff}, rgba.RGBAAt(1, 0))
+	assert.Equal(t, color.RGBA{A: 0xff}, rgba.RGBAAt(2, 0))
+	assert.Equal(t, rgba, embedders.ImageToRGBA(embedders.ImageToRGBA(img), embedders.DropAlpha))
+
+	rgba = embedders.ImageToRGBA(img, embedders.CompositeAlpha(color.White))
+	assert.Equal(t, color.RGBA{R: 200, G: 100, B: 50, A: 0xff}, rgba.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{R: 244, G: 224, B: 214, A: 0xff}, rgba.RGBAAt(1, 0))
+	assert.Equal(t, color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, rgba.RGBAAt(2, 0))
+	// The images are composited onto white if the background is nil
+	assert.Equal(t, rgba, embedders.ImageToRGBA(img, embedders.CompositeAlpha(nil)))
+	// The same as image/draw composites them
+	bg := color.RGBA{R: 10, G: 200, B: 90, A: 0xff}
+	want := image.NewRGBA(img.Bounds())
+	draw.Draw(want, want.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(want, want.Bounds(), img, image.Point{}, draw.Over)
+	assert.Equal(t, want, embedders.ImageToRGBA(img, embedders.CompositeAlpha(bg)))
+
+	// The image itself is never modified, and the opaque images are returned as they are
+	src := embedders.ImageToRGBA(img)
+	embedders.ImageToRGBA(src, embedders.DropAlpha)
+	embedders.ImageToRGBA(src, embedders.CompositeAlpha(color.Black))
+	assert.Equal(t, embedders.ImageToRGBA(img), src)
+	opaque := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	draw.Draw(opaque, opaque.Bounds(), image.Black, image.Point{}, draw.Src)
+	assert.Same(t, opaque, embedders.ImageToRGBA(opaque, embedders.DropAlpha))
+	assert.Nil(t, embedders.ImageToRGBA(nil, embedders.DropAlpha))
+}
+
+func TestEmbeddersAlphaPolicy(t *testing.T) {
+	orig, err := loadImage("../testdata/pokemon/abomasnow.png")
+	assert.NoError(t, err)
+	// The transparent PNG image and its JPEG export, with the transparency flattened to white
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, cutOutBackground(orig)))
+	transparent, _, err := image.Decode(&buf)
+	assert.NoError(t, err)
+	buf.Reset()
+	assert.NoError(t, jpeg.Encode(&buf, embedders.ImageToRGBA(transparent, embedders.CompositeAlpha(color.White)),
+		&jpeg.Options{Quality: 90}))
+	exported, _, err := image.Decode(&buf)
+	assert.NoError(t, err)
+
+	composition := func(policy ...embedders.AlphaPolicy) embedders.ImageEmbedder {
+		return embedders.Composition([]embedders.ImageEmbedder{
+			embedders.NewColorDispersionEmbedder(policy...),
+			embedders.NewLowResolutionEmbedder(8, 8, policy...),
+		})
+	}
+	distance := func(e embedders.ImageEmbedder) float64 {
+		a, err := embedders.Embed(e, transparent)
+		assert.NoError(t, err)
+		b, err := embedders.Embed(e, exported)
+		assert.NoError(t, err)
+		return a.Distance(b)
+	}
+	assert.Greater(t, distance(composition()), 10.)
+	assert.Greater(t, distance(composition(embedders.DropAlpha)), 10.)
+	composited := composition(embedders.CompositeAlpha(color.White))
+	assert.Equal(t, composition().Dims(), composited.Dims())
+	assert.Less(t, distance(composited), 0.01)
+
+	// The transparent image matches the original
+	assertMatches(t, composited, "../testdata/compressed_abomasnow.jpg", 0.05)
+	a, err := embedders.Embed(composited, transparent)
+	assert.NoError(t, err)
+	b, err := composited.Img2Vec(orig)
+	assert.NoError(t, err)
+	assert.Less(t, a.Distance(b), 0.01)
+
+	// The embedders read the image with the policy applied, whatever its type is
+	for _, e := range []embedders.ImageEmbedder{
+		embedders.NewLowResolutionEmbedder(4, 4, embedders.DropAlpha),
+		embedders.NewColorDispersionEmbedder(embedders.DropAlpha),
+		embedders.NewColorHistogramEmbedder(embedders.HSV, 8, 3, 3, embedders.CompositeAlpha(color.Black)),
+		embedders.NewAHashEmbedder(8, embedders.CompositeAlpha(color.White)),
+		embedders.NewDHashEmbedder(8, embedders.CompositeAlpha(color.White)),
+		embedders.NewPHashEmbedder(8, embedders.CompositeAlpha(color.White)),
+		embedders.NewWHashEmbedder(8, 2, embedders.CompositeAlpha(color.White)),
+		embedders.NewHOGEmbedder(4, 4, 9, embedders.CompositeAlpha(color.White)),
+	} {
+		want, err := e.Img2Vec(embedders.ImageToRGBA(transparent))
+		assert.NoError(t, err)
+		got, err := embedders.Embed(e, transparent)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	// The hashes take the transparent pixels as black unless the image is flattened
+	hash := func(e embedders.ImageEmbedder, img image.Image) embedders.Vector {
+		vec, err := embedders.Embed(e, img)
+		assert.NoError(t, err)
+		return vec
+	}
+	want := hash(embedders.NewAHashEmbedder(8), orig)
+	assert.Greater(t, want.Distance(hash(embedders.NewAHashEmbedder(8), transparent)), 2.)
+	assert.Equal(t, want, hash(embedders.NewAHashEmbedder(8, embedders.CompositeAlpha(color.White)), transparent))
+}
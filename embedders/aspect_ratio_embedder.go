@@ -14,10 +14,14 @@ func NewAspectRatioEmbedder() ImageEmbedder {
 }
 
 func (r aspectRatioEmbedder) Img2Vec(image *image.RGBA) (Vector, error) {
+	return r.embed(pixelsOf(image))
+}
+
+func (r aspectRatioEmbedder) embed(image *pixels) (Vector, error) {
 	if image == nil {
 		return nil, ErrEmptyImage
 	}
-	size := image.Bounds().Size()
+	size := image.bounds.Size()
 
 	switch {
 	case size.X == 0 || size.Y == 0:
@@ -0,0 +1,193 @@
+package embedders
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// ColorSpace is a color space the colors are converted to by the color histogram embedder
+type ColorSpace int
+
+const (
+	// HSV is the hue, saturation, value color space. The hue is undefined for gray colors, they fall into the first hue bin.
+	HSV ColorSpace = iota
+	// Lab is the CIE L*a*b* color space with the D65 white point. It's perceptually uniform:
+	// the same distance between colors means the same perceived difference.
+	Lab
+)
+
+func (s ColorSpace) String() string {
+	switch s {
+	case HSV:
+		return "HSV"
+	case Lab:
+		return "Lab"
+	}
+	return fmt.Sprintf("ColorSpace(%d)", int(s))
+}
+
+// channelRanges are the ranges of the channels of the color spaces
+var channelRanges = map[ColorSpace][3][2]float64{
+	HSV: {{0, 360}, {0, 1}, {0, 1}},
+	Lab: {{0, 100}, {-128, 128}, {-128, 128}},
+}
+
+// srgbToLinear maps sRGB channel values to linear ones
+var srgbToLinear = func() (table [256]float64) {
+	for i := range table {
+		c := float64(i) / 255
+		if c <= 0.04045 {
+			table[i] = c / 12.92
+		} else {
+			table[i] = math.Pow((c+0.055)/1.055, 2.4)
+		}
+	}
+	return table
+}()
+
+type colorHistogramEmbedder struct {
+	Space ColorSpace
+	Bins  [3]int
+	Alpha AlphaPolicy
+}
+
+// NewColorHistogramEmbedder returns an embedder that calculates a joint histogram of the image colors
+// in the given color space, with the given number of bins per channel: H, S, V or L*, a*, b*.
+//
+// It produces vectors of bins1*bins2*bins3 numbers: the fraction of the image pixels that fall into each bin.
+// The numbers sum up to 1, so the vectors of images of different sizes are comparable.
+// The histogram ignores the layout of the image, so it tells apart the images with the same layout,
+// but different palettes. Semi-transparent pixels are counted in proportion to their opacity,
+// unless the optional policy makes the image opaque first.
+// E.g. NewColorHistogramEmbedder(embedders.HSV, 8, 3, 3) produces vectors of 72 numbers.
+func NewColorHistogramEmbedder(space ColorSpace, bins1, bins2, bins3 int, policy ...AlphaPolicy) ImageEmbedder {
+	return colorHistogramEmbedder{Space: space, Bins: [3]int{bins1, bins2, bins3}, Alpha: alphaPolicy(policy)}
+}
+
+func (e colorHistogramEmbedder) Dims() int {
+	return e.Bins[0] * e.Bins[1] * e.Bins[2]
+}
+
+func (e colorHistogramEmbedder) Img2Vec(img *image.RGBA) (Vector, error) {
+	return e.embed(pixelsOf(img))
+}
+
+func (e colorHistogramEmbedder) embed(img *pixels) (Vector, error) {
+	return embedRows(e, img)
+}
+
+func (e colorHistogramEmbedder) rowReader(img *pixels) (rowReader, error) {
+	ranges, ok := channelRanges[e.Space]
+	if !ok {
+		return nil, fmt.Errorf("colorHistogramEmbedder doesn't support %v", e.Space)
+	}
+	for _, bins := range e.Bins {
+		if bins <= 0 {
+			return nil, fmt.Errorf("colorHistogramEmbedder's Bins parameters must be greater than 0")
+		}
+	}
+	if img.empty() {
+		return nil, ErrEmptyImage
+	}
+	return e.Alpha.reader(&histogramReader{e: e, ranges: ranges, vec: make(Vector, e.Dims())}), nil
+}
+
+// histogramReader counts the pixels of the image in the bins of colorHistogramEmbedder e
+type histogramReader struct {
+	e      colorHistogramEmbedder
+	ranges [3][2]float64
+	vec    Vector
+	total  float64
+}
+
+func (h *histogramReader) readRow(_ int, row []uint8) {
+	for i := 0; i < len(row); i += 4 {
+		s := row[i : i+4 : i+4]
+		if s[3] == 0 {
+			continue
+		}
+		// The pixels are alpha-premultiplied
+		r, g, bl := unpremultiply(s[0], s[3]), unpremultiply(s[1], s[3]), unpremultiply(s[2], s[3])
+		var c [3]float64
+		if h.e.Space == HSV {
+			c = rgbToHSV(r, g, bl)
+		} else {
+			c = rgbToLab(r, g, bl)
+		}
+		bin := 0
+		for ch := range c {
+			bin = bin*h.e.Bins[ch] + channelBin(c[ch], h.ranges[ch], h.e.Bins[ch])
+		}
+		weight := float64(s[3]) / 255
+		h.vec[bin] += weight
+		h.total += weight
+	}
+}
+
+func (h *histogramReader) vector() (Vector, error) {
+	if h.total > 0 {
+		for i := range h.vec {
+			h.vec[i] /= h.total
+		}
+	}
+	return h.vec, nil
+}
+
+func unpremultiply(c, a uint8) uint8 {
+	return uint8((int(c)*255 + int(a)/2) / int(a))
+}
+
+// channelBin returns the bin the value falls into, out-of-range values fall into the outermost bins
+func channelBin(v float64, r [2]float64, bins int) int {
+	bin := int((v - r[0]) / (r[1] - r[0]) * float64(bins))
+	switch {
+	case bin < 0:
+		return 0
+	case bin >= bins:
+		return bins - 1
+	}
+	return bin
+}
+
+func rgbToHSV(r, g, b uint8) [3]float64 {
+	rf, gf, bf := float64(r)/255, float64(g)/255, float64(b)/255
+	max := math.Max(rf, math.Max(gf, bf))
+	min := math.Min(rf, math.Min(gf, bf))
+	delta := max - min
+	var h, s float64
+	if max > 0 {
+		s = delta / max
+	}
+	if delta > 0 {
+		switch max {
+		case rf:
+			h = math.Mod((gf-bf)/delta, 6)
+		case gf:
+			h = (bf-rf)/delta + 2
+		default:
+			h = (rf-gf)/delta + 4
+		}
+		h *= 60
+		if h < 0 {
+			h += 360
+		}
+	}
+	return [3]float64{h, s, max}
+}
+
+func rgbToLab(r, g, b uint8) [3]float64 {
+	rl, gl, bl := srgbToLinear[r], srgbToLinear[g], srgbToLinear[b]
+	// linear sRGB to XYZ, normalised by the D65 white point
+	x := (0.4124564*rl + 0.3575761*gl + 0.1804375*bl) / 0.95047
+	y := 0.2126729*rl + 0.7151522*gl + 0.0721750*bl
+	z := (0.0193339*rl + 0.1191920*gl + 0.9503041*bl) / 1.08883
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
@@ -0,0 +1,87 @@
+package embedders_test
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestColorHistogramEmbedderImg2Vec(t *testing.T) {
+	// White and black pixels have no hue, they fall into the first hue bin. Red has the hue of 0, green of 120.
+	e := embedders.NewColorHistogramEmbedder(embedders.HSV, 4, 2, 2)
+	assert.Equal(t, 16, e.Dims())
+	vec, err := e.Img2Vec(createTestImage(100, 100))
+	assert.NoError(t, err)
+	total := 3 + 127.0/255 // the green quadrant is half transparent
+	expected := make(embedders.Vector, 16)
+	expected[0b0000] = 1 / total           // black: H 0, S 0, V 0
+	expected[0b0001] = 1 / total           // white: H 0, S 0, V 1
+	expected[0b0011] = 1 / total           // red: H 0, S 1, V 1
+	expected[0b0111] = 127.0 / 255 / total // green: H 1, S 1, V 1
+	assert.True(t, almostEqualSlices(expected, vec, 1e-9), "expected %v, got %v", expected, vec)
+
+	// The L* of purple is 37, its a* is positive and b* is negative
+	e = embedders.NewColorHistogramEmbedder(embedders.Lab, 4, 2, 2)
+	vec, err = e.Img2Vec(createMonochromeImage(10, 10))
+	assert.NoError(t, err)
+	expected = make(embedders.Vector, 16)
+	expected[1<<2|1<<1|0] = 1
+	assert.Equal(t, expected, vec)
+}
+
+func TestColorHistogramEmbedderSizeInvariance(t *testing.T) {
+	for _, space := range []embedders.ColorSpace{embedders.HSV, embedders.Lab} {
+		e := embedders.NewColorHistogramEmbedder(space, 8, 3, 3)
+		big, err := e.Img2Vec(createTestImage(200, 200))
+		assert.NoError(t, err)
+		small, err := e.Img2Vec(createTestImage(20, 20))
+		assert.NoError(t, err)
+		assert.True(t, almostEqualSlices(big, small, 1e-9), "%v: %v != %v", space, big, small)
+
+		// The same layout with a different palette is far away
+		recolored, err := e.Img2Vec(swapRedBlue(createTestImage(200, 200)))
+		assert.NoError(t, err)
+		assert.Greater(t, big.Distance(recolored), 0.1, space)
+	}
+}
+
+func TestColorHistogramEmbedderComposition(t *testing.T) {
+	e := embedders.Composition([]embedders.ImageEmbedder{
+		embedders.NewPHashEmbedder(8),
+		embedders.NewColorHistogramEmbedder(embedders.HSV, 8, 3, 3),
+	})
+	assert.Equal(t, 64+72, e.Dims())
+	vec, err := e.Img2Vec(createTestImage(200, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, e.Dims(), len(vec))
+}
+
+func TestColorHistogramEmbedderErrors(t *testing.T) {
+	_, err := embedders.NewColorHistogramEmbedder(embedders.HSV, 8, 3, 3).Img2Vec(nil)
+	assert.ErrorIs(t, err, embedders.ErrEmptyImage)
+	_, err = embedders.NewColorHistogramEmbedder(embedders.HSV, 8, 0, 3).Img2Vec(createTestImage(10, 10))
+	assert.Error(t, err)
+	_, err = embedders.NewColorHistogramEmbedder(embedders.ColorSpace(42), 8, 3, 3).Img2Vec(createTestImage(10, 10))
+	assert.ErrorContains(t, err, "ColorSpace(42)")
+
+	// A fully transparent image has no colors
+	vec, err := embedders.NewColorHistogramEmbedder(embedders.Lab, 2, 2, 2).Img2Vec(image.NewRGBA(image.Rect(0, 0, 5, 5)))
+	assert.NoError(t, err)
+	assert.Equal(t, make(embedders.Vector, 8), vec)
+}
+
+// swapRedBlue returns a copy of the image with the red and blue channels swapped
+func swapRedBlue(img *image.RGBA) *image.RGBA {
+	res := image.NewRGBA(img.Bounds())
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			res.SetRGBA(x, y, color.RGBA{R: c.B, G: c.G, B: c.R, A: c.A})
+		}
+	}
+	return res
+}
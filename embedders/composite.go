@@ -6,18 +6,48 @@ type compositeEmbedder struct {
 	Embedders []ImageEmbedder
 }
 
-// Composition returns a new embedder that converts image into a vector produced as a concatenation of the given embedders' vectors
+// Composition returns a new embedder that converts image into a vector produced as a concatenation of the given embedders' vectors.
+// The embedders of this package that read the pixels of the image read it together, one row at a time.
 func Composition(embedders []ImageEmbedder) ImageEmbedder {
 	return compositeEmbedder{Embedders: embedders}
 }
 
 func (a compositeEmbedder) Img2Vec(image *image.RGBA) (Vector, error) {
+	return a.embed(pixelsOf(image))
+}
+
+func (a compositeEmbedder) embed(image *pixels) (Vector, error) {
 	if image == nil {
 		return nil, ErrEmptyImage
 	}
+	// The embedders that read the image row by row read it together, so each row is converted once for all of them
+	readers := make([]rowReader, len(a.Embedders))
+	var rowReaders []rowReader
+	for i, e := range a.Embedders {
+		if re, ok := e.(rowEmbedder); ok {
+			r, err := re.rowReader(image)
+			if err != nil {
+				return nil, err
+			}
+			readers[i] = r
+			rowReaders = append(rowReaders, r)
+		}
+	}
+	readRows(image, rowReaders...)
 	var v Vector
-	for _, e := range a.Embedders {
-		vec, err := e.Img2Vec(image)
+	for i, e := range a.Embedders {
+		var (
+			vec Vector
+			err error
+		)
+		if readers[i] != nil {
+			vec, err = readers[i].vector()
+		} else if pe, ok := e.(pixelsEmbedder); ok {
+			vec, err = pe.embed(image)
+		} else {
+			// The image is converted once for all the embedders that need it
+			vec, err = e.Img2Vec(image.toRGBA())
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,56 @@
+package embedders
+
+import (
+	"fmt"
+	"image"
+)
+
+type dHashEmbedder struct {
+	HashSize int
+	Alpha    AlphaPolicy
+}
+
+// NewDHashEmbedder returns an embedder that calculates a difference hash of an image.
+//
+// The image is converted to grayscale and downsampled to a (hashSize+1)*hashSize thumbnail,
+// then each pixel is compared to its right neighbour.
+// It produces vectors of hashSize*hashSize numbers, 1 where the brightness increases from left to right
+// and 0 elsewhere, so the distance between two vectors is the Hamming distance between the hashes.
+// It's almost as cheap as the average hash, but it tracks gradients, so it tolerates gamma and contrast changes.
+// The alpha channel is ignored, the optional policy tells what the transparent pixels are.
+func NewDHashEmbedder(hashSize int, policy ...AlphaPolicy) ImageEmbedder {
+	return dHashEmbedder{HashSize: hashSize, Alpha: alphaPolicy(policy)}
+}
+
+func (e dHashEmbedder) Dims() int {
+	return e.HashSize * e.HashSize
+}
+
+func (e dHashEmbedder) Img2Vec(img *image.RGBA) (Vector, error) {
+	return e.embed(pixelsOf(img))
+}
+
+func (e dHashEmbedder) embed(img *pixels) (Vector, error) {
+	return embedRows(e, img)
+}
+
+func (e dHashEmbedder) rowReader(img *pixels) (rowReader, error) {
+	if e.HashSize <= 0 {
+		return nil, fmt.Errorf("dHashEmbedder's HashSize parameter must be greater than 0")
+	}
+	if img.empty() {
+		return nil, ErrEmptyImage
+	}
+	width := e.HashSize + 1
+	return e.Alpha.reader(newThumbnailReader(img.bounds, width, e.HashSize, func(gray []float64) Vector {
+		vec := make(Vector, e.Dims())
+		for row := 0; row < e.HashSize; row++ {
+			for col := 0; col < e.HashSize; col++ {
+				if gray[row*width+col] < gray[row*width+col+1] {
+					vec[row*e.HashSize+col] = 1
+				}
+			}
+		}
+		return vec
+	})), nil
+}
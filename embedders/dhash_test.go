@@ -0,0 +1,58 @@
+package embedders_test
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDHashEmbedderImg2Vec(t *testing.T) {
+	// The brightness decreases from left to right in both halves of the test image:
+	// from white to black, and from red to the transparent green, which is darker
+	vec, err := embedders.NewDHashEmbedder(2).Img2Vec(createTestImage(90, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, embedders.Vector{0, 0, 0, 0}, vec)
+
+	// ... and increases in a horizontal gradient
+	gradient := image.NewRGBA(image.Rect(0, 0, 90, 100))
+	for x := 0; x < 90; x++ {
+		for y := 0; y < 100; y++ {
+			gradient.Set(x, y, color.Gray{Y: uint8(x)})
+		}
+	}
+	vec, err = embedders.NewDHashEmbedder(2).Img2Vec(gradient)
+	assert.NoError(t, err)
+	assert.Equal(t, embedders.Vector{1, 1, 1, 1}, vec)
+
+	e := embedders.NewDHashEmbedder(8)
+	assert.Equal(t, 64, e.Dims())
+	vec, err = e.Img2Vec(createTestImage(100, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, e.Dims(), len(vec))
+	assertBinary(t, vec)
+}
+
+func TestDHashEmbedderRobustness(t *testing.T) {
+	assertMatches(t, embedders.NewDHashEmbedder(8), "../testdata/compressed_abomasnow.jpg", 4)
+}
+
+func TestDHashEmbedderGamma(t *testing.T) {
+	e := embedders.NewDHashEmbedder(8)
+	img, err := loadImage("../testdata/pokemon/abomasnow.png")
+	assert.NoError(t, err)
+	vec, err := e.Img2Vec(img)
+	assert.NoError(t, err)
+	corrected, err := e.Img2Vec(adjustGamma(img, 1.5))
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, vec.Distance(corrected), 2.0)
+}
+
+func TestDHashEmbedderErrors(t *testing.T) {
+	_, err := embedders.NewDHashEmbedder(8).Img2Vec(nil)
+	assert.ErrorIs(t, err, embedders.ErrEmptyImage)
+	_, err = embedders.NewDHashEmbedder(0).Img2Vec(createTestImage(10, 10))
+	assert.Error(t, err)
+}
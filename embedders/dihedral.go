@@ -0,0 +1,117 @@
+package embedders
+
+import (
+	"fmt"
+	"image"
+)
+
+// dihedralTransforms is the number of ways to flip and rotate an image by a multiple of 90 degrees
+const dihedralTransforms = 8
+
+type dihedralInvariantEmbedder struct {
+	Embedder ImageEmbedder
+}
+
+// NewDihedralInvariantEmbedder returns an embedder that makes the index match the images flipped
+// and rotated by a multiple of 90 degrees to the images it contains.
+//
+// Img2Vec returns the vector of the image itself, the same as the given embedder does. Variants returns the vectors
+// of the image transformed in each of the 8 ways. The index searches with all of them and takes the nearest result,
+// so a mirrored or rotated copy of an image is as close to it as an upright copy. The searches embed the image
+// 8 times, so they take 8 times longer to embed, adding the images doesn't.
+//
+// It must be the outermost embedder, or be wrapped by NewPreprocessingEmbedder only: e.g. a Composition
+// doesn't search with the variants of its embedders.
+func NewDihedralInvariantEmbedder(embedder ImageEmbedder) ImageEmbedder {
+	return dihedralInvariantEmbedder{Embedder: embedder}
+}
+
+func (e dihedralInvariantEmbedder) Dims() int {
+	return e.Embedder.Dims()
+}
+
+func (e dihedralInvariantEmbedder) Img2Vec(img *image.RGBA) (Vector, error) {
+	if img == nil || img.Bounds().Empty() {
+		return nil, ErrEmptyImage
+	}
+	return e.Embedder.Img2Vec(img)
+}
+
+func (e dihedralInvariantEmbedder) Variants(img *image.RGBA) ([]Vector, error) {
+	if img == nil || img.Bounds().Empty() {
+		return nil, ErrEmptyImage
+	}
+	vecs := make([]Vector, dihedralTransforms)
+	for t := range vecs {
+		var err error
+		if vecs[t], err = e.Embedder.Img2Vec(transformRGBA(img, t)); err != nil {
+			return nil, err
+		}
+	}
+	return vecs, nil
+}
+
+// exifTransforms maps the values of the EXIF orientation tag to the transforms that display the image upright
+var exifTransforms = [...]int{1: 0, 2: 1, 3: 3, 4: 2, 5: 4, 6: 6, 7: 7, 8: 5}
+
+// Orient flips and rotates the image according to the value of its EXIF orientation tag, so that it's upright.
+// The values are in range [1..8], 1 means the image is upright already, and it's returned as ImageToRGBA returns it.
+// Otherwise, a transformed *image.RGBA copy of the image is returned. The image types Embed reads directly are
+// transformed as they are read, without a converted copy.
+func Orient(img image.Image, orientation int) (*image.RGBA, error) {
+	if orientation < 1 || orientation >= len(exifTransforms) {
+		return nil, fmt.Errorf("invalid EXIF orientation %d", orientation)
+	}
+	if img == nil {
+		return nil, ErrEmptyImage
+	}
+	if orientation == 1 {
+		return ImageToRGBA(img), nil
+	}
+	p, ok := readPixels(img)
+	if !ok {
+		p = pixelsOf(ImageToRGBA(img))
+	}
+	return transform(p, exifTransforms[orientation]), nil
+}
+
+// transformRGBA returns the image transformed by the t-th of the dihedral transforms, see transform.
+// The 0-th transform is the identity, it returns the image itself.
+func transformRGBA(img *image.RGBA, t int) *image.RGBA {
+	if t == 0 {
+		return img
+	}
+	return transform(pixelsOf(img), t)
+}
+
+// transform returns a copy of the image transformed by the t-th of the dihedral transforms:
+// bit 0 of t mirrors it horizontally, bit 1 mirrors it vertically and bit 2 mirrors it along the main diagonal.
+func transform(img *pixels, t int) *image.RGBA {
+	b := img.bounds
+	w, h := b.Dx(), b.Dy()
+	transpose := t&4 != 0
+	resW, resH := w, h
+	if transpose {
+		resW, resH = h, w
+	}
+	res := image.NewRGBA(image.Rect(0, 0, resW, resH))
+	for srcY := 0; srcY < h; srcY++ {
+		row := img.row(b.Min.Y+srcY, b.Min.X, b.Max.X)
+		y := srcY
+		if t&2 != 0 {
+			y = h - 1 - y
+		}
+		for srcX := 0; srcX < w; srcX++ {
+			x := srcX
+			if t&1 != 0 {
+				x = w - 1 - x
+			}
+			i := res.PixOffset(x, y)
+			if transpose {
+				i = res.PixOffset(y, x)
+			}
+			copy(res.Pix[i:i+4], row[srcX*4:srcX*4+4])
+		}
+	}
+	return res
+}
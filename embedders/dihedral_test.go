@@ -0,0 +1,145 @@
+package embedders_test
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
+)
+
+// rotate90 returns a copy of the image rotated by 90 degrees clockwise
+func rotate90(img *image.RGBA) *image.RGBA {
+	b := img.Bounds()
+	res := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			res.SetRGBA(b.Max.Y-1-y, x-b.Min.X, img.RGBAAt(x, y))
+		}
+	}
+	return res
+}
+
+// mirror returns a copy of the image mirrored horizontally
+func mirror(img *image.RGBA) *image.RGBA {
+	b := img.Bounds()
+	res := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			res.SetRGBA(b.Max.X-1-x, y-b.Min.Y, img.RGBAAt(x, y))
+		}
+	}
+	return res
+}
+
+func TestDihedralInvariantEmbedder(t *testing.T) {
+	inner := embedders.Composition([]embedders.ImageEmbedder{
+		embedders.NewAspectRatioEmbedder(),
+		embedders.NewLowResolutionEmbedder(4, 4),
+	})
+	e := embedders.NewDihedralInvariantEmbedder(inner)
+	assert.Equal(t, inner.Dims(), e.Dims())
+
+	img := createTestImage(100, 60)
+	img.SetRGBA(10, 5, color.RGBA{B: 255, A: 255}) // breaks the symmetry of the quadrants
+	vec, err := e.Img2Vec(img)
+	assert.NoError(t, err)
+	expected, err := inner.Img2Vec(img)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, vec)
+
+	ve, ok := e.(embedders.VariantEmbedder)
+	assert.True(t, ok)
+	variants, err := ve.Variants(img)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, len(variants))
+	assert.Equal(t, expected, variants[0])
+
+	// Each of the transformed copies has the same variants as the image, so one of them matches it exactly
+	variant := img
+	for i := 0; i < 4; i++ {
+		for _, v := range []*image.RGBA{variant, mirror(variant)} {
+			vecs, err := ve.Variants(v)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, variants, vecs)
+			assert.Contains(t, vecs, expected)
+		}
+		variant = rotate90(variant)
+	}
+
+	// The inner embedder tells the variants apart
+	b, err := inner.Img2Vec(rotate90(img))
+	assert.NoError(t, err)
+	assert.NotEqual(t, expected, b)
+}
+
+func TestDihedralInvariantEmbedderSubImage(t *testing.T) {
+	// The transforms respect the bounds of the image
+	img := createTestImage(100, 60)
+	sub := img.SubImage(image.Rect(50, 0, 100, 60)).(*image.RGBA)
+	e := embedders.NewDihedralInvariantEmbedder(embedders.NewAHashEmbedder(2)).(embedders.VariantEmbedder)
+	expected, err := e.Variants(sub)
+	assert.NoError(t, err)
+	vecs, err := e.Variants(rotate90(sub))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, expected, vecs)
+}
+
+func TestDihedralInvariantEmbedderPreprocessing(t *testing.T) {
+	// The preprocessing embedder searches with the variants of the dihedral embedder it wraps
+	img := createTestImage(100, 60)
+	inner := embedders.NewDihedralInvariantEmbedder(embedders.NewAHashEmbedder(2))
+	expected, err := inner.(embedders.VariantEmbedder).Variants(img)
+	assert.NoError(t, err)
+	vecs, err := embedders.EmbedVariants(embedders.NewBorderTrimmingEmbedder(inner, 0, 1), img)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, vecs)
+	vecs, err = embedders.EmbedVariants(embedders.NewBorderTrimmingEmbedder(embedders.NewAHashEmbedder(2), 0, 1), img)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(vecs))
+}
+
+func TestDihedralInvariantEmbedderErrors(t *testing.T) {
+	e := embedders.NewDihedralInvariantEmbedder(embedders.NewLowResolutionEmbedder(8, 8))
+	_, err := e.Img2Vec(nil)
+	assert.ErrorIs(t, err, embedders.ErrEmptyImage)
+	_, err = e.Img2Vec(createTestImage(4, 4))
+	assert.Error(t, err)
+	_, err = embedders.EmbedVariants(e, nil)
+	assert.ErrorIs(t, err, embedders.ErrEmptyImage)
+	_, err = embedders.EmbedVariants(e, createTestImage(4, 4))
+	assert.Error(t, err)
+}
+
+func TestOrient(t *testing.T) {
+	img := createTestImage(30, 20)
+	img.SetRGBA(1, 2, color.RGBA{B: 255, A: 255})
+	rotate180 := func(img *image.RGBA) *image.RGBA { return rotate90(rotate90(img)) }
+	for orientation, expected := range map[int]*image.RGBA{
+		1: img,
+		2: mirror(img),
+		3: rotate180(img),
+		4: mirror(rotate180(img)),
+		5: mirror(rotate90(img)),
+		6: rotate90(img),
+		7: mirror(rotate90(rotate180(img))),
+		8: rotate90(rotate180(img)),
+	} {
+		res, err := embedders.Orient(img, orientation)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, res, "orientation %d", orientation)
+		// The other types are transformed as they are read, the same as their RGBA copies
+		for name, other := range imagesOfAllTypes(t, img) {
+			res, err := embedders.Orient(other, orientation)
+			assert.NoError(t, err)
+			expected, err := embedders.Orient(embedders.ImageToRGBA(other), orientation)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, res, "%s orientation %d", name, orientation)
+		}
+	}
+	_, err := embedders.Orient(img, 9)
+	assert.Error(t, err)
+	_, err = embedders.Orient(img, 0)
+	assert.Error(t, err)
+}
@@ -1,16 +1,20 @@
 package embedders
 
 import (
+	"fmt"
 	"image"
 	"math"
 )
 
-type colorDispersionEmbedder struct{}
+type colorDispersionEmbedder struct {
+	Alpha AlphaPolicy
+}
 
 // NewColorDispersionEmbedder calculates dispersion of each color in the image
-// and returns a vector of 3 components: red, green, blue color dispersion in range [0..1]
-func NewColorDispersionEmbedder() ImageEmbedder {
-	return colorDispersionEmbedder{}
+// and returns a vector of 3 components: red, green, blue color dispersion in range [0..1].
+// The alpha channel is ignored, so the transparent pixels are black unless the optional policy flattens them.
+func NewColorDispersionEmbedder(policy ...AlphaPolicy) ImageEmbedder {
+	return colorDispersionEmbedder{Alpha: alphaPolicy(policy)}
 }
 
 func (v colorDispersionEmbedder) Dims() int {
@@ -18,19 +22,55 @@ func (v colorDispersionEmbedder) Dims() int {
 }
 
 func (v colorDispersionEmbedder) Img2Vec(image *image.RGBA) (Vector, error) {
-	means, err := lowResolutionEmbedder{1, 1}.Img2Vec(image)
-	if err != nil {
-		return nil, err
+	return v.embed(pixelsOf(image))
+}
+
+func (v colorDispersionEmbedder) embed(image *pixels) (Vector, error) {
+	return embedRows(v, image)
+}
+
+func (v colorDispersionEmbedder) rowReader(image *pixels) (rowReader, error) {
+	if image == nil {
+		return nil, fmt.Errorf("image must be non-nil")
+	}
+	bounds := image.bounds
+	if bounds.Empty() {
+		return nil, fmt.Errorf("image width and height must be greater than 0")
 	}
-	rgbaImage := ImageToRGBA(image)
-	var r, g, b float64
-	for i := 0; i < len(rgbaImage.Pix); i += 4 {
-
-		r += math.Abs(means[0] - float64(rgbaImage.Pix[i])/255)
-		g += math.Abs(means[1] - float64(rgbaImage.Pix[i+1])/255)
-		b += math.Abs(means[2] - float64(rgbaImage.Pix[i+2])/255)
-		// rgbaImage.Pix[i+3] is alpha channel, it's intentionally ignored
+	return v.Alpha.reader(&dispersionReader{pixelCount: float64(bounds.Dx() * bounds.Dy())}), nil
+}
+
+// dispersionReader counts the levels of each channel, so the pixels are read once, not for the means and then
+// for the deviations from them
+type dispersionReader struct {
+	pixelCount float64
+	hist       [3][256]int
+}
+
+func (d *dispersionReader) readRow(_ int, row []uint8) {
+	for i := 0; i < len(row); i += 4 {
+		d.hist[0][row[i]]++
+		d.hist[1][row[i+1]]++
+		d.hist[2][row[i+2]]++
+		// row[i+3] is alpha channel, it's intentionally ignored
+	}
+}
+
+func (d *dispersionReader) vector() (Vector, error) {
+	vec := make(Vector, 3)
+	for c := range vec {
+		total := 0
+		for level, n := range d.hist[c] {
+			total += level * n
+		}
+		mean := float64(total) / (d.pixelCount * 255)
+		var sum float64
+		for level, n := range d.hist[c] {
+			if n > 0 {
+				sum += math.Abs(mean-float64(level)/255) * float64(n)
+			}
+		}
+		vec[c] = 2 * sum / d.pixelCount
 	}
-	pixelCount := float64(image.Bounds().Dx() * image.Bounds().Dy())
-	return []float64{2 * r / pixelCount, 2 * g / pixelCount, 2 * b / pixelCount}, nil
+	return vec, nil
 }
@@ -26,3 +26,25 @@ type ImageEmbedder interface {
 	// Dims returns the number of dimensions of vectors produced by the ImageEmbedder
 	Dims() int
 }
+
+// VariantEmbedder is implemented by the embedders that embed several variants of an image,
+// e.g. its flipped and rotated copies. The index stores the vector returned by Img2Vec,
+// and searches with the vectors of all the variants, so the distance to an image is the minimum of them.
+type VariantEmbedder interface {
+	ImageEmbedder
+	// Variants returns the vectors of the variants of the image, the first of them is the one Img2Vec returns
+	Variants(*image.RGBA) ([]Vector, error)
+}
+
+// EmbedVariants returns the vectors of the variants of the image if the embedder is a VariantEmbedder,
+// otherwise it returns the single vector returned by Embed
+func EmbedVariants(e ImageEmbedder, img image.Image) ([]Vector, error) {
+	if ve, ok := e.(VariantEmbedder); ok {
+		return ve.Variants(ImageToRGBA(img))
+	}
+	vec, err := Embed(e, img)
+	if err != nil {
+		return nil, err
+	}
+	return []Vector{vec}, nil
+}
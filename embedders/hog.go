@@ -0,0 +1,120 @@
+package embedders
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+const (
+	// hogCellSide is the side of a cell in pixels of the thumbnail hogEmbedder calculates the gradients on
+	hogCellSide = 8
+	// hogEpsilon keeps the histograms of flat cells, where the gradients are mostly noise, close to zero
+	hogEpsilon = 0.01
+)
+
+type hogEmbedder struct {
+	Width  int
+	Height int
+	Bins   int
+	Alpha  AlphaPolicy
+}
+
+// NewHOGEmbedder returns an embedder that calculates a histogram of oriented gradients (HOG) of an image.
+//
+// The image is converted to grayscale and downsampled to a thumbnail, which is split into width*height cells.
+// The gradient orientations of each cell are put into bins orientation bins weighted by the gradient magnitudes.
+// The orientations are unsigned, so a dark shape on a light background has the same histogram as a light one
+// on a dark background, and each cell histogram is normalised to the unit length, so the contrast doesn't matter
+// either. That makes the embedder capture the structure of the image, such as the edges of logos and line art,
+// and ignore recoloring. The alpha channel is ignored, the optional policy tells what the transparent pixels are.
+// It produces vectors of width*height*bins numbers in range [0..1]. width=4, height=4 and bins=9 is a good start.
+func NewHOGEmbedder(width, height, bins int, policy ...AlphaPolicy) ImageEmbedder {
+	return hogEmbedder{Width: width, Height: height, Bins: bins, Alpha: alphaPolicy(policy)}
+}
+
+func (e hogEmbedder) Dims() int {
+	return e.Width * e.Height * e.Bins
+}
+
+func (e hogEmbedder) Img2Vec(img *image.RGBA) (Vector, error) {
+	return e.embed(pixelsOf(img))
+}
+
+func (e hogEmbedder) embed(img *pixels) (Vector, error) {
+	return embedRows(e, img)
+}
+
+func (e hogEmbedder) rowReader(img *pixels) (rowReader, error) {
+	if e.Width <= 0 || e.Height <= 0 || e.Bins <= 0 {
+		return nil, fmt.Errorf("hogEmbedder's Width, Height and Bins parameters must be greater than 0")
+	}
+	if img.empty() {
+		return nil, ErrEmptyImage
+	}
+	return e.Alpha.reader(newThumbnailReader(img.bounds, e.Width*hogCellSide, e.Height*hogCellSide, e.histograms)), nil
+}
+
+// histograms returns the normalized histograms of gradient orientations of the cells of the grayscale thumbnail
+func (e hogEmbedder) histograms(gray []float64) Vector {
+	width, height := e.Width*hogCellSide, e.Height*hogCellSide
+	at := func(x, y int) float64 {
+		// The edges of the thumbnail are repeated, so there are no gradients at the border
+		x = clamp(x, 0, width-1)
+		y = clamp(y, 0, height-1)
+		return gray[y*width+x]
+	}
+	vec := make(Vector, e.Dims())
+	binWidth := math.Pi / float64(e.Bins)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			gx := at(x+1, y) - at(x-1, y)
+			gy := at(x, y+1) - at(x, y-1)
+			magnitude := math.Hypot(gx, gy)
+			if magnitude == 0 {
+				continue
+			}
+			orientation := math.Atan2(gy, gx)
+			if orientation < 0 {
+				orientation += math.Pi
+			}
+			// The magnitude is split between the two nearest bins, so a slight rotation doesn't move it to
+			// another bin entirely. The bins wrap around, as 0 and Pi are the same orientation.
+			pos := orientation / binWidth
+			lower := math.Floor(pos)
+			frac := pos - lower
+			cell := ((y/hogCellSide)*e.Width + x/hogCellSide) * e.Bins
+			vec[cell+wrap(int(lower), e.Bins)] += magnitude * (1 - frac)
+			vec[cell+wrap(int(lower)+1, e.Bins)] += magnitude * frac
+		}
+	}
+	for cell := 0; cell < len(vec); cell += e.Bins {
+		hist := vec[cell : cell+e.Bins]
+		var norm float64
+		for i := range hist {
+			// The mean gradient per pixel doesn't depend on the cell size
+			hist[i] /= hogCellSide * hogCellSide
+			norm += hist[i] * hist[i]
+		}
+		norm = math.Sqrt(norm + hogEpsilon*hogEpsilon)
+		for i := range hist {
+			hist[i] /= norm
+		}
+	}
+	return vec
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// wrap returns the bin index i modulo n
+func wrap(i, n int) int {
+	return ((i % n) + n) % n
+}
@@ -0,0 +1,117 @@
+package embedders_test
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
+)
+
+// drawShape returns an image of the shape drawn with fg color on bg color,
+// the shape is a ring if ring is true and a cross otherwise
+func drawShape(width, height int, ring bool, fg, bg color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dx, dy := float64(x)/float64(width)-0.5, float64(y)/float64(height)-0.5
+			var inside bool
+			if ring {
+				r := math.Hypot(dx, dy)
+				inside = r > 0.25 && r < 0.4
+			} else {
+				inside = math.Abs(dx) < 0.1 || math.Abs(dy) < 0.1
+			}
+			if inside {
+				img.Set(x, y, fg)
+			} else {
+				img.Set(x, y, bg)
+			}
+		}
+	}
+	return img
+}
+
+func TestHOGEmbedderImg2Vec(t *testing.T) {
+	// The vertical edge between the halves has horizontal gradients, which fall into the first bin
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	for y := 0; y < 50; y++ {
+		for x := 50; x < 100; x++ {
+			img.Set(x, y, color.White)
+		}
+	}
+	e := embedders.NewHOGEmbedder(2, 1, 4)
+	assert.Equal(t, 8, e.Dims())
+	vec, err := e.Img2Vec(img)
+	assert.NoError(t, err)
+	assert.True(t, almostEqualSlices(embedders.Vector{1, 0, 0, 0, 1, 0, 0, 0}, vec, 0.01), "%v", vec)
+
+	// The same edge rotated by 90 degrees falls into the bin of vertical gradients
+	vec, err = embedders.NewHOGEmbedder(1, 2, 4).Img2Vec(transpose(img))
+	assert.NoError(t, err)
+	assert.True(t, almostEqualSlices(embedders.Vector{0, 0, 1, 0, 0, 0, 1, 0}, vec, 0.01), "%v", vec)
+
+	// A flat image has no gradients
+	vec, err = embedders.NewHOGEmbedder(4, 4, 9).Img2Vec(createMonochromeImage(10, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, make(embedders.Vector, 144), vec)
+}
+
+func TestHOGEmbedderIgnoresRecoloring(t *testing.T) {
+	e := embedders.NewHOGEmbedder(4, 4, 9)
+	embed := func(img *image.RGBA) embedders.Vector {
+		vec, err := e.Img2Vec(img)
+		assert.NoError(t, err)
+		assert.Equal(t, e.Dims(), len(vec))
+		return vec
+	}
+	ring := embed(drawShape(200, 200, true, color.Black, color.White))
+	recolored := []*image.RGBA{
+		drawShape(200, 200, true, color.RGBA{R: 200, A: 255}, color.RGBA{R: 255, G: 230, A: 255}),
+		drawShape(200, 200, true, color.White, color.RGBA{B: 80, A: 255}),
+		drawShape(120, 120, true, color.RGBA{G: 100, B: 100, A: 255}, color.RGBA{R: 90, G: 90, B: 90, A: 255}),
+	}
+	cross := embed(drawShape(200, 200, false, color.Black, color.White))
+	for _, img := range recolored {
+		assert.Less(t, ring.Distance(embed(img)), ring.Distance(cross)/10)
+	}
+
+	// The color-based embedders tell the recolored images apart
+	lowRes := embedders.NewLowResolutionEmbedder(4, 4)
+	a, err := lowRes.Img2Vec(drawShape(200, 200, true, color.Black, color.White))
+	assert.NoError(t, err)
+	b, err := lowRes.Img2Vec(recolored[1])
+	assert.NoError(t, err)
+	assert.Greater(t, a.Distance(b), 1.)
+}
+
+func TestHOGEmbedderRobustness(t *testing.T) {
+	assertMatches(t, embedders.NewHOGEmbedder(4, 4, 9), "../testdata/compressed_abomasnow.jpg", 0.5)
+}
+
+func TestHOGEmbedderErrors(t *testing.T) {
+	_, err := embedders.NewHOGEmbedder(4, 4, 9).Img2Vec(nil)
+	assert.ErrorIs(t, err, embedders.ErrEmptyImage)
+	_, err = embedders.NewHOGEmbedder(4, 4, 0).Img2Vec(createTestImage(10, 10))
+	assert.Error(t, err)
+	_, err = embedders.NewHOGEmbedder(0, 4, 9).Img2Vec(createTestImage(10, 10))
+	assert.Error(t, err)
+	// Images smaller than the thumbnail are accepted
+	vec, err := embedders.NewHOGEmbedder(4, 4, 9).Img2Vec(createTestImage(3, 3))
+	assert.NoError(t, err)
+	assert.Equal(t, 144, len(vec))
+}
+
+// transpose returns a copy of the image mirrored along its main diagonal
+func transpose(img *image.RGBA) *image.RGBA {
+	b := img.Bounds()
+	res := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			res.SetRGBA(y-b.Min.Y, x-b.Min.X, img.RGBAAt(x, y))
+		}
+	}
+	return res
+}
@@ -9,6 +9,7 @@ import (
 type lowResolutionEmbedder struct {
 	Width  int
 	Height int
+	Alpha  AlphaPolicy
 }
 
 func (v lowResolutionEmbedder) Dims() int {
@@ -17,66 +18,155 @@ func (v lowResolutionEmbedder) Dims() int {
 
 // Img2Vec returns the vector representation of the image.
 func (v lowResolutionEmbedder) Img2Vec(img *image.RGBA) (Vector, error) {
+	return v.embed(pixelsOf(img))
+}
+
+func (v lowResolutionEmbedder) embed(img *pixels) (Vector, error) {
+	return embedRows(v, img)
+}
+
+func (v lowResolutionEmbedder) rowReader(img *pixels) (rowReader, error) {
 	if v.Width <= 0 || v.Height <= 0 {
 		return nil, fmt.Errorf("lowResolutionEmbedder's Width and Height parameters must be greater than 0")
 	}
 	if img == nil {
 		return nil, fmt.Errorf("image must be non-nil")
 	}
-	if img.Bounds().Dx() <= 0 || img.Bounds().Dy() <= 0 {
+	b := img.bounds
+	if b.Dx() <= 0 || b.Dy() <= 0 {
 		return nil, fmt.Errorf("image width and height must be greater than 0")
 	}
-	if v.Width > img.Bounds().Dx() || v.Height > img.Bounds().Dy() {
+	if v.Width > b.Dx() || v.Height > b.Dy() {
 		return nil, fmt.Errorf(
 			"image width and height must not be less than lowResolutionEmbedder's Width and Height parameters")
 	}
+	return v.Alpha.reader(newCellAverages(b, v.Width, v.Height)), nil
+}
 
-	vec := make(Vector, v.Height*v.Width*4)
-	for row := 0; row < v.Height; row++ {
-		for col := 0; col < v.Width; col++ {
-			minX := col * img.Bounds().Dx() / v.Width
-			maxX := (col + 1) * img.Bounds().Dx() / v.Width
-			minY := row * img.Bounds().Dy() / v.Height
-			maxY := (row + 1) * img.Bounds().Dy() / v.Height
-			rgba := getAverageColorRGBA(img, minX, maxX, minY, maxY)
-			for i, f := range rgba {
-				vec[row*v.Width*4+col*4+i] = f
-			}
+// span is a range [min..max) of pixel coordinates
+type span struct {
+	min, max int
+}
+
+// splitSpan splits [min..min+size) into n spans of about the same length. A span is never less than one pixel,
+// so they overlap if size is less than n.
+func splitSpan(min, size, n int) []span {
+	spans := make([]span, n)
+	for i := range spans {
+		s := span{min + i*size/n, min + (i+1)*size/n}
+		if s.max <= s.min {
+			s.max = s.min + 1
 		}
+		spans[i] = s
 	}
-	return vec, nil
+	return spans
+}
+
+// cellAverages is a rowReader that splits the image into height*width rectangles and sums up each channel
+// of the pixels in each of them. Its vector is the average color of each rectangle, 4 channels in range [0..1],
+// row by row, the same as lowResolutionEmbedder returns.
+type cellAverages struct {
+	minX       int
+	cols, rows []span
+	// next is the first row of rectangles the next rows of the image may fall into
+	next int
+	sums [][4]int
 }
 
-// getAverageColorRGBA returns the average color of the given area of the image.
-func getAverageColorRGBA(img *image.RGBA, minX int, maxX int, minY int, maxY int) [4]float64 {
-	var (
-		avgColorsInt   [4]int // 4 channels: R, G, B, A
-		avgColorsFloat [4]float64
-		pixelCount     = (maxX - minX) * (maxY - minY)
-		divider        = float64(pixelCount * 255)
-	)
-	if divider == 0 { //image is empty, return zeros
-		return avgColorsFloat
-	}
-	for x := minX; x < maxX; x++ {
-		for y := minY; y < maxY; y++ {
-			i := img.PixOffset(x, y)
-			s := img.Pix[i : i+4 : i+4]
-			for i, c := range s {
-				avgColorsInt[i] += int(c)
+func newCellAverages(b image.Rectangle, width, height int) *cellAverages {
+	return &cellAverages{
+		minX: b.Min.X,
+		cols: splitSpan(b.Min.X, b.Dx(), width),
+		rows: splitSpan(b.Min.Y, b.Dy(), height),
+		sums: make([][4]int, width*height),
+	}
+}
+
+func (c *cellAverages) readRow(y int, row []uint8) {
+	// Both ends of the spans only grow, and the rows are read top to bottom
+	for c.next < len(c.rows) && c.rows[c.next].max <= y {
+		c.next++
+	}
+	for r := c.next; r < len(c.rows) && c.rows[r].min <= y; r++ {
+		sums := c.sums[r*len(c.cols) : (r+1)*len(c.cols)]
+		for col, s := range c.cols {
+			var sum [4]int
+			pix := row[(s.min-c.minX)*4 : (s.max-c.minX)*4]
+			for i := 0; i < len(pix); i += 4 {
+				p := pix[i : i+4 : i+4]
+				sum[0] += int(p[0])
+				sum[1] += int(p[1])
+				sum[2] += int(p[2])
+				sum[3] += int(p[3])
+			}
+			for i := range sum {
+				sums[col][i] += sum[i]
 			}
 		}
 	}
-	for i, c := range avgColorsInt {
-		avgColorsFloat[i] = float64(c) / divider
+}
+
+// average returns the average color of the i-th rectangle, 4 channels in range [0..1]
+func (c *cellAverages) average(i int) [4]float64 {
+	col, row := c.cols[i%len(c.cols)], c.rows[i/len(c.cols)]
+	divider := float64((col.max - col.min) * (row.max - row.min) * 255)
+	var avg [4]float64
+	for ch, sum := range c.sums[i] {
+		avg[ch] = float64(sum) / divider
 	}
-	return avgColorsFloat
+	return avg
 }
 
-func ImageToRGBA(img image.Image) *image.RGBA {
+func (c *cellAverages) vector() (Vector, error) {
+	vec := make(Vector, 0, len(c.sums)*4)
+	for i := range c.sums {
+		avg := c.average(i)
+		vec = append(vec, avg[:]...)
+	}
+	return vec, nil
+}
+
+// gray returns the average luma of each rectangle in range [0..1], row by row
+func (c *cellAverages) gray() []float64 {
+	gray := make([]float64, len(c.sums))
+	for i := range gray {
+		rgba := c.average(i)
+		// ITU-R BT.601 luma, the same as color.GrayModel uses
+		gray[i] = 0.299*rgba[0] + 0.587*rgba[1] + 0.114*rgba[2]
+	}
+	return gray
+}
+
+// thumbnailReader is a rowReader that downsamples the image to a grayscale thumbnail, see cellAverages,
+// and embeds the thumbnail. Unlike lowResolutionEmbedder, it accepts images smaller than the thumbnail.
+type thumbnailReader struct {
+	*cellAverages
+	embed func(gray []float64) Vector
+}
+
+// newThumbnailReader returns a thumbnailReader that downsamples the image to a width*height thumbnail
+// and embeds it with embed
+func newThumbnailReader(b image.Rectangle, width, height int, embed func(gray []float64) Vector) thumbnailReader {
+	return thumbnailReader{cellAverages: newCellAverages(b, width, height), embed: embed}
+}
+
+func (t thumbnailReader) vector() (Vector, error) {
+	return t.embed(t.gray()), nil
+}
+
+// ImageToRGBA converts the image to *image.RGBA, treating its transparency according to the optional policy,
+// which is KeepAlpha by default. It never modifies the image, but it returns the image itself if it's *image.RGBA
+// already and there is nothing to change.
+func ImageToRGBA(img image.Image, policy ...AlphaPolicy) *image.RGBA {
 	if img == nil {
 		return nil
 	}
+	p := alphaPolicy(policy)
+	if p.mode != keepAlpha {
+		if o, ok := img.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+			return flattenAlpha(img, p)
+		}
+	}
 	if rgba, ok := img.(*image.RGBA); ok {
 		return rgba
 	}
@@ -86,11 +176,27 @@ func ImageToRGBA(img image.Image) *image.RGBA {
 	return rgba
 }
 
+// flattenAlpha converts the image to *image.RGBA with its transparency treated according to the policy
+func flattenAlpha(img image.Image, policy AlphaPolicy) *image.RGBA {
+	src, ok := readPixels(img)
+	if !ok {
+		src = pixelsOf(ImageToRGBA(img))
+	}
+	b := src.bounds
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		policy.apply(rgba.Pix[rgba.PixOffset(0, y-b.Min.Y):rgba.PixOffset(b.Dx(), y-b.Min.Y)], src.row(y, b.Min.X, b.Max.X))
+	}
+	return rgba
+}
+
 // NewLowResolutionEmbedder returns an embedder that takes an image, splits it into height*width rectangle
 // and calculates the average amount of each channel (3 colors + alpha) in each rectangle.
 // It produces vectors of height*width*4 numbers in range [0..1]
 // E.g. for an image filled with red color (#FF0000) entirely and the following parameters: height=3, width=4
-// the resulting vector would be [1,0,0,0,1,0,0,0 ... 1,0,0,0], total vector length is 48
-func NewLowResolutionEmbedder(width int, height int) ImageEmbedder {
-	return lowResolutionEmbedder{width, height}
+// the resulting vector would be [1,0,0,0,1,0,0,0 ... 1,0,0,0], total vector length is 48.
+// The alpha channel is averaged too, so a transparent image is far from its flattened copy unless
+// the optional policy, e.g. CompositeAlpha(color.White), flattens it first.
+func NewLowResolutionEmbedder(width int, height int, policy ...AlphaPolicy) ImageEmbedder {
+	return lowResolutionEmbedder{Width: width, Height: height, Alpha: alphaPolicy(policy)}
 }
@@ -2,11 +2,13 @@ package embedders_test
 
 import (
 	"image"
+	"image/draw"
 	_ "image/jpeg"
 	"math"
 	"testing"
 
 	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestLowResEmbedderImg2Vec(t *testing.T) {
@@ -125,3 +127,26 @@ func TestLowResEmbedderDims(t *testing.T) {
 		t.Errorf("GetSize() returned %v, but the actual vector size is got: %v", size, len(vec))
 	}
 }
+
+func TestLowResEmbedderSubImage(t *testing.T) {
+	// A sub-image is embedded the same way as a copy of its pixels
+	img := createTestImage(100, 100)
+	sub := img.SubImage(image.Rect(50, 25, 100, 75)).(*image.RGBA)
+	for _, e := range []embedders.ImageEmbedder{
+		embedders.NewLowResolutionEmbedder(2, 2),
+		embedders.NewColorDispersionEmbedder(),
+	} {
+		expected, err := e.Img2Vec(copyImage(sub))
+		assert.NoError(t, err)
+		vec, err := e.Img2Vec(sub)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, vec)
+	}
+}
+
+// copyImage returns a copy of the image with the origin at (0, 0)
+func copyImage(img *image.RGBA) *image.RGBA {
+	res := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(res, res.Bounds(), img, img.Bounds().Min, draw.Src)
+	return res
+}
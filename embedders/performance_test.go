@@ -2,6 +2,8 @@ package embedders_test
 
 import (
 	"github.com/alef-ru/imgidx/embedders"
+	"image"
+	"image/color"
 	_ "image/jpeg"
 	"testing"
 
@@ -58,3 +60,148 @@ func BenchmarkDispersionEmbedder_Img2Vec_NoConversion_8_8(b *testing.B) {
 		assert.NoError(b, err)
 	}
 }
+
+// benchmarkEmbed compares embedding the image with embedders.Embed, which reads the most common types directly,
+// to converting it to *image.RGBA first
+func benchmarkEmbed(b *testing.B, e embedders.ImageEmbedder, img image.Image) {
+	b.Run("Embed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := embedders.Embed(e, img)
+			assert.NoError(b, err)
+		}
+	})
+	b.Run("Conversion", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := e.Img2Vec(embedders.ImageToRGBA(img))
+			assert.NoError(b, err)
+		}
+	})
+}
+
+// newBenchmarkComposition returns the composition of the embedders an index is usually created with
+func newBenchmarkComposition() embedders.ImageEmbedder {
+	return embedders.Composition([]embedders.ImageEmbedder{
+		embedders.NewAspectRatioEmbedder(),
+		embedders.NewColorDispersionEmbedder(),
+		embedders.NewLowResolutionEmbedder(8, 8),
+	})
+}
+
+// BenchmarkEmbed embeds the images of each type with each embedder
+//
+// BenchmarkEmbed/LowRes_8_8/Gray/Conversion                                 781      1528047 ns/op    1054256 B/op     9 allocs/op
+// BenchmarkEmbed/LowRes_8_8/Gray/Embed                                      783      1499891 ns/op       7664 B/op     8 allocs/op
+// BenchmarkEmbed/LowRes_8_8/NRGBA/Conversion                                398      2750241 ns/op    1054256 B/op     9 allocs/op
+// BenchmarkEmbed/LowRes_8_8/NRGBA/Embed                                     495      2369480 ns/op       7664 B/op     8 allocs/op
+// BenchmarkEmbed/LowRes_8_8/Paletted/Conversion                             254      4946669 ns/op    1054256 B/op     9 allocs/op
+// BenchmarkEmbed/LowRes_8_8/Paletted/Embed                                  853      1406434 ns/op       7664 B/op     8 allocs/op
+// BenchmarkEmbed/LowRes_8_8/RGBA/Conversion                                1364       877248 ns/op       5616 B/op     7 allocs/op
+// BenchmarkEmbed/LowRes_8_8/RGBA/Embed                                     1272       875919 ns/op       5616 B/op     7 allocs/op
+// BenchmarkEmbed/LowRes_8_8/RGBA64/Conversion                               361      3278530 ns/op    1054256 B/op     9 allocs/op
+// BenchmarkEmbed/LowRes_8_8/RGBA64/Embed                                    352      3354039 ns/op    1054256 B/op     9 allocs/op
+// BenchmarkEmbed/LowRes_8_8/YCbCrYCbCrSubsampleRatio411/Conversion          193      6221070 ns/op    1054256 B/op     9 allocs/op
+// BenchmarkEmbed/LowRes_8_8/YCbCrYCbCrSubsampleRatio411/Embed               194      6101886 ns/op    1054256 B/op     9 allocs/op
+// BenchmarkEmbed/LowRes_8_8/YCbCrYCbCrSubsampleRatio420/Conversion          422      2844730 ns/op    1054256 B/op     9 allocs/op
+// BenchmarkEmbed/LowRes_8_8/YCbCrYCbCrSubsampleRatio420/Embed               456      2605395 ns/op       7664 B/op     8 allocs/op
+// BenchmarkEmbed/LowRes_8_8/YCbCrYCbCrSubsampleRatio422/Conversion          391      3043395 ns/op    1054256 B/op     9 allocs/op
+// BenchmarkEmbed/LowRes_8_8/YCbCrYCbCrSubsampleRatio422/Embed               434      2743257 ns/op       7664 B/op     8 allocs/op
+// BenchmarkEmbed/LowRes_8_8/YCbCrYCbCrSubsampleRatio440/Conversion          459      2659097 ns/op    1054256 B/op     9 allocs/op
+// BenchmarkEmbed/LowRes_8_8/YCbCrYCbCrSubsampleRatio440/Embed               435      2637533 ns/op       7664 B/op     8 allocs/op
+// BenchmarkEmbed/LowRes_8_8/YCbCrYCbCrSubsampleRatio444/Conversion          411      2890650 ns/op    1054256 B/op     9 allocs/op
+// BenchmarkEmbed/LowRes_8_8/YCbCrYCbCrSubsampleRatio444/Embed               418      2522293 ns/op       7664 B/op     8 allocs/op
+//
+// Before the rows were shared by the embedders of the composition:
+// BenchmarkEmbed/Composition/Gray/Conversion                                546      2228546 ns/op    1054216 B/op     9 allocs/op
+// BenchmarkEmbed/Composition/Gray/Embed                                     427      2822474 ns/op       7624 B/op     8 allocs/op
+// BenchmarkEmbed/Composition/NRGBA/Conversion                               331      3696694 ns/op    1054216 B/op     9 allocs/op
+// BenchmarkEmbed/Composition/NRGBA/Embed                                    266      4351658 ns/op       7624 B/op     8 allocs/op
+// BenchmarkEmbed/Composition/Paletted/Conversion                            226      5229804 ns/op    1054216 B/op     9 allocs/op
+// BenchmarkEmbed/Composition/Paletted/Embed                                 457      2600826 ns/op       7624 B/op     8 allocs/op
+// BenchmarkEmbed/Composition/RGBA/Conversion                                778      1501793 ns/op       5576 B/op     7 allocs/op
+// BenchmarkEmbed/Composition/RGBA/Embed                                     760      1535566 ns/op       5576 B/op     7 allocs/op
+// BenchmarkEmbed/Composition/RGBA64/Conversion                              291      4182118 ns/op    1054216 B/op     9 allocs/op
+// BenchmarkEmbed/Composition/RGBA64/Embed                                   373      3698051 ns/op    1054216 B/op     9 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio411/Conversion         175      6738154 ns/op    1054216 B/op     9 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio411/Embed              181      6784717 ns/op    1054216 B/op     9 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio420/Conversion         322      3510531 ns/op    1054216 B/op     9 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio420/Embed              237      5035062 ns/op       7624 B/op     8 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio422/Conversion         373      2851389 ns/op    1054216 B/op     9 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio422/Embed              205      5540497 ns/op       7624 B/op     8 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio440/Conversion         440      3002217 ns/op    1054216 B/op     9 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio440/Embed              276      4648760 ns/op       7624 B/op     8 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio444/Conversion         331      3610782 ns/op    1054216 B/op     9 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio444/Embed              210      5694330 ns/op       7624 B/op     8 allocs/op
+//
+// After:
+// BenchmarkEmbed/Composition/Gray/Conversion                                534      2190252 ns/op    1063192 B/op    15 allocs/op
+// BenchmarkEmbed/Composition/Gray/Embed                                     518      2174752 ns/op      16600 B/op    14 allocs/op
+// BenchmarkEmbed/Composition/NRGBA/Conversion                               319      3275165 ns/op    1063192 B/op    15 allocs/op
+// BenchmarkEmbed/Composition/NRGBA/Embed                                    411      2796013 ns/op      16600 B/op    14 allocs/op
+// BenchmarkEmbed/Composition/Paletted/Conversion                            219      5363764 ns/op    1063192 B/op    15 allocs/op
+// BenchmarkEmbed/Composition/Paletted/Embed                                 550      2181790 ns/op      16600 B/op    14 allocs/op
+// BenchmarkEmbed/Composition/RGBA/Conversion                                735      1673996 ns/op      14552 B/op    13 allocs/op
+// BenchmarkEmbed/Composition/RGBA/Embed                                     690      1642054 ns/op      14552 B/op    13 allocs/op
+// BenchmarkEmbed/Composition/RGBA64/Conversion                              297      3922861 ns/op    1063192 B/op    15 allocs/op
+// BenchmarkEmbed/Composition/RGBA64/Embed                                   285      4123870 ns/op    1063192 B/op    15 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio411/Conversion         174      6567102 ns/op    1063192 B/op    15 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio411/Embed              174      6851582 ns/op    1063192 B/op    15 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio420/Conversion         331      3569884 ns/op    1063192 B/op    15 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio420/Embed              368      2783316 ns/op      16600 B/op    14 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio422/Conversion         279      5090075 ns/op    1063192 B/op    15 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio422/Embed              345      3532947 ns/op      16600 B/op    14 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio440/Conversion         338      3544444 ns/op    1063192 B/op    15 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio440/Embed              350      3447633 ns/op      16600 B/op    14 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio444/Conversion         342      3395976 ns/op    1063192 B/op    15 allocs/op
+// BenchmarkEmbed/Composition/YCbCrYCbCrSubsampleRatio444/Embed              322      3283285 ns/op      16600 B/op    14 allocs/op
+func BenchmarkEmbed(b *testing.B) {
+	images := imagesOfAllTypes(b, decodeFile(b, "testdata/lenna.png"))
+	for _, bm := range []struct {
+		name     string
+		embedder embedders.ImageEmbedder
+	}{
+		{"LowRes_8_8", embedders.NewLowResolutionEmbedder(8, 8)},
+		{"LowRes_8_8_CompositeAlpha", embedders.NewLowResolutionEmbedder(8, 8, embedders.CompositeAlpha(color.White))},
+		{"PHash_8", embedders.NewPHashEmbedder(8)},
+		{"AHash_8", embedders.NewAHashEmbedder(8)},
+		{"DHash_8", embedders.NewDHashEmbedder(8)},
+		{"WHash_8_2", embedders.NewWHashEmbedder(8, 2)},
+		{"ColorHistogram_HSV_8_3_3", embedders.NewColorHistogramEmbedder(embedders.HSV, 8, 3, 3)},
+		{"ColorHistogram_Lab_4_4_4", embedders.NewColorHistogramEmbedder(embedders.Lab, 4, 4, 4)},
+		{"HOG_4_4_9", embedders.NewHOGEmbedder(4, 4, 9)},
+		{"Composition", newBenchmarkComposition()},
+		{"DihedralInvariant_LowRes_8_8", embedders.NewDihedralInvariantEmbedder(embedders.NewLowResolutionEmbedder(8, 8))},
+		{"BorderTrimming_LowRes_8_8", embedders.NewBorderTrimmingEmbedder(embedders.NewLowResolutionEmbedder(8, 8), 0.2, 8)},
+		{"Pipeline_LowRes_8_8", embedders.NewPreprocessingEmbedder(embedders.Pipeline([]embedders.Preprocessor{
+			embedders.NewBorderTrimPreprocessor(0.2, 8),
+			embedders.NewResizePreprocessor(256),
+			embedders.NewGammaPreprocessor(),
+		}), embedders.NewLowResolutionEmbedder(8, 8))},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for name, img := range images {
+				b.Run(name, func(b *testing.B) {
+					benchmarkEmbed(b, bm.embedder, img)
+				})
+			}
+		})
+	}
+}
+
+// BenchmarkEmbed_Composition_Large embeds a 24 megapixel JPEG-like image, which ImageToRGBA copies into 96 MB
+//
+// BenchmarkEmbed_Composition_Large/Conversion                                 4    276710091 ns/op   96016664 B/op    15 allocs/op
+// BenchmarkEmbed_Composition_Large/Conversion                                 4    313355083 ns/op   96016664 B/op    15 allocs/op
+// BenchmarkEmbed_Composition_Large/Conversion                                 4    327308792 ns/op   96016664 B/op    15 allocs/op
+// BenchmarkEmbed_Composition_Large/Embed                                      4    269785531 ns/op      39128 B/op    14 allocs/op
+// BenchmarkEmbed_Composition_Large/Embed                                      4    299652199 ns/op      39128 B/op    14 allocs/op
+// BenchmarkEmbed_Composition_Large/Embed                                      5    235782022 ns/op      39128 B/op    14 allocs/op
+func BenchmarkEmbed_Composition_Large(b *testing.B) {
+	img := image.NewYCbCr(image.Rect(0, 0, 6000, 4000), image.YCbCrSubsampleRatio420)
+	for i := range img.Y {
+		img.Y[i] = uint8(i)
+	}
+	for i := range img.Cb {
+		img.Cb[i], img.Cr[i] = uint8(i/7), uint8(i/3)
+	}
+	benchmarkEmbed(b, newBenchmarkComposition(), img)
+}
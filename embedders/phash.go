@@ -0,0 +1,112 @@
+package embedders
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+)
+
+// pHashScale is the ratio of the side of the grayscale thumbnail the DCT is applied to, to the hash side
+const pHashScale = 4
+
+type pHashEmbedder struct {
+	HashSize int
+	Alpha    AlphaPolicy
+}
+
+// NewPHashEmbedder returns an embedder that calculates a DCT-based perceptual hash of an image.
+//
+// The image is converted to grayscale and downsampled to a (4*hashSize)x(4*hashSize) thumbnail,
+// then the hashSize*hashSize lowest frequencies of its discrete cosine transform are compared to their median.
+// It produces vectors of hashSize*hashSize numbers, 1 for the frequencies above the median and 0 for the rest,
+// so the distance between two vectors is the Hamming distance between the hashes.
+// The hash depends on the structure of the image rather than on its exact colors,
+// so it tolerates compression, gamma and contrast changes, and mild cropping.
+// The alpha channel is ignored, the optional policy tells what the transparent pixels are.
+// hashSize=8 produces the classic 64-bit pHash.
+func NewPHashEmbedder(hashSize int, policy ...AlphaPolicy) ImageEmbedder {
+	return pHashEmbedder{HashSize: hashSize, Alpha: alphaPolicy(policy)}
+}
+
+func (e pHashEmbedder) Dims() int {
+	return e.HashSize * e.HashSize
+}
+
+func (e pHashEmbedder) Img2Vec(img *image.RGBA) (Vector, error) {
+	return e.embed(pixelsOf(img))
+}
+
+func (e pHashEmbedder) embed(img *pixels) (Vector, error) {
+	return embedRows(e, img)
+}
+
+func (e pHashEmbedder) rowReader(img *pixels) (rowReader, error) {
+	if e.HashSize <= 0 {
+		return nil, fmt.Errorf("pHashEmbedder's HashSize parameter must be greater than 0")
+	}
+	if img.empty() {
+		return nil, ErrEmptyImage
+	}
+	side := e.HashSize * pHashScale
+	return e.Alpha.reader(newThumbnailReader(img.bounds, side, side, func(gray []float64) Vector {
+		coefs := lowFrequencies(gray, side, e.HashSize)
+		return binarize(coefs, median(coefs))
+	})), nil
+}
+
+// lowFrequencies applies the 2D DCT-II to the side*side matrix and returns
+// the n*n lowest frequency coefficients row by row.
+func lowFrequencies(m []float64, side, n int) []float64 {
+	// cos[k*side+i] is the DCT basis function of frequency k at point i
+	cos := make([]float64, n*side)
+	for k := 0; k < n; k++ {
+		for i := 0; i < side; i++ {
+			cos[k*side+i] = math.Cos(math.Pi / float64(side) * (float64(i) + 0.5) * float64(k))
+		}
+	}
+	// The transform is separable: the rows are transformed first, then the columns of the result
+	rows := make([]float64, side*n)
+	for y := 0; y < side; y++ {
+		for k := 0; k < n; k++ {
+			var sum float64
+			for x := 0; x < side; x++ {
+				sum += m[y*side+x] * cos[k*side+x]
+			}
+			rows[y*n+k] = sum
+		}
+	}
+	coefs := make([]float64, n*n)
+	for k := 0; k < n; k++ {
+		for col := 0; col < n; col++ {
+			var sum float64
+			for y := 0; y < side; y++ {
+				sum += rows[y*n+col] * cos[k*side+y]
+			}
+			coefs[k*n+col] = sum
+		}
+	}
+	return coefs
+}
+
+func median(values []float64) float64 {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// binarize returns a vector of 1 for the values greater than the threshold and 0 for the rest
+func binarize(values []float64, threshold float64) Vector {
+	vec := make(Vector, len(values))
+	for i, v := range values {
+		if v > threshold {
+			vec[i] = 1
+		}
+	}
+	return vec
+}
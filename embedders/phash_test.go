@@ -0,0 +1,111 @@
+package embedders_test
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
+)
+
+// embedFile loads the image and embeds it, failing the test on errors
+func embedFile(t *testing.T, e embedders.ImageEmbedder, filePath string) embedders.Vector {
+	img, err := loadImage(filePath)
+	assert.NoError(t, err, "Failed to load test image %s", filePath)
+	vec, err := e.Img2Vec(img)
+	assert.NoError(t, err, "Failed to embed test image %s", filePath)
+	return vec
+}
+
+// assertMatches checks that the copy of abomasnow.png at needlePath is closer to it than any other pokemon,
+// and not farther than maxDist
+func assertMatches(t *testing.T, e embedders.ImageEmbedder, needlePath string, maxDist float64) {
+	const pokemonDir = "../testdata/pokemon"
+	orig := embedFile(t, e, path.Join(pokemonDir, "abomasnow.png"))
+	dist := orig.Distance(embedFile(t, e, needlePath))
+	assert.LessOrEqual(t, dist, maxDist)
+	files, err := os.ReadDir(pokemonDir)
+	assert.NoError(t, err)
+	for _, f := range files {
+		if f.Name() == "abomasnow.png" {
+			continue
+		}
+		other := orig.Distance(embedFile(t, e, path.Join(pokemonDir, f.Name())))
+		assert.Less(t, dist, other, "%s is closer to abomasnow.png than %s", f.Name(), needlePath)
+	}
+}
+
+func assertBinary(t *testing.T, vec embedders.Vector) {
+	for i, v := range vec {
+		assert.True(t, v == 0 || v == 1, "vec[%d] = %v, 0 or 1 expected", i, v)
+	}
+}
+
+func TestPHashEmbedderDims(t *testing.T) {
+	for _, hashSize := range []int{8, 16} {
+		e := embedders.NewPHashEmbedder(hashSize)
+		assert.Equal(t, hashSize*hashSize, e.Dims())
+		vec, err := e.Img2Vec(createTestImage(100, 100))
+		assert.NoError(t, err)
+		assert.Equal(t, e.Dims(), len(vec))
+		assertBinary(t, vec)
+	}
+}
+
+func TestPHashEmbedderRobustness(t *testing.T) {
+	assertMatches(t, embedders.NewPHashEmbedder(8), "../testdata/compressed_abomasnow.jpg", 4)
+	assertMatches(t, embedders.NewPHashEmbedder(8), "../testdata/distorted_abomasnow.jpg", 16)
+}
+
+func TestPHashEmbedderGamma(t *testing.T) {
+	e := embedders.NewPHashEmbedder(8)
+	img, err := loadImage("../testdata/pokemon/abomasnow.png")
+	assert.NoError(t, err)
+	vec, err := e.Img2Vec(img)
+	assert.NoError(t, err)
+	corrected, err := e.Img2Vec(adjustGamma(img, 1.5))
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, vec.Distance(corrected), 2.0)
+}
+
+func TestPHashEmbedderErrors(t *testing.T) {
+	_, err := embedders.NewPHashEmbedder(8).Img2Vec(nil)
+	assert.ErrorIs(t, err, embedders.ErrEmptyImage)
+	_, err = embedders.NewPHashEmbedder(8).Img2Vec(createTestImage(0, 0))
+	assert.ErrorIs(t, err, embedders.ErrEmptyImage)
+	_, err = embedders.NewPHashEmbedder(0).Img2Vec(createTestImage(10, 10))
+	assert.Error(t, err)
+	// Images smaller than the thumbnail are accepted
+	vec, err := embedders.NewPHashEmbedder(8).Img2Vec(createTestImage(3, 3))
+	assert.NoError(t, err)
+	assert.Equal(t, 64, len(vec))
+}
+
+func TestPHashEmbedderComposition(t *testing.T) {
+	e := embedders.Composition([]embedders.ImageEmbedder{
+		embedders.NewAspectRatioEmbedder(),
+		embedders.NewPHashEmbedder(8),
+	})
+	assert.Equal(t, 65, e.Dims())
+	vec, err := e.Img2Vec(createTestImage(200, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, 65, len(vec))
+}
+
+// adjustGamma returns a copy of the image with the gamma correction applied to its colors
+func adjustGamma(img *image.RGBA, gamma float64) *image.RGBA {
+	res := image.NewRGBA(img.Bounds())
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			adjust := func(v uint8) uint8 { return uint8(math.Round(255 * math.Pow(float64(v)/255, 1/gamma))) }
+			res.SetRGBA(x, y, color.RGBA{R: adjust(c.R), G: adjust(c.G), B: adjust(c.B), A: c.A})
+		}
+	}
+	return res
+}
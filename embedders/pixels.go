@@ -0,0 +1,205 @@
+package embedders
+
+import (
+	"image"
+)
+
+// pixelsEmbedder is implemented by the embedders that read the images through pixels,
+// so they embed the images of the types pixels supports without converting them to *image.RGBA
+type pixelsEmbedder interface {
+	embed(img *pixels) (Vector, error)
+}
+
+// rowEmbedder is implemented by the pixelsEmbedders that read the images row by row, top to bottom.
+// Composition reads each row of an image once for all of them, so the row is converted once too.
+type rowEmbedder interface {
+	// rowReader returns the reader of the rows of the image, or an error if the embedder can't embed the image
+	rowReader(img *pixels) (rowReader, error)
+}
+
+// rowReader reads the rows of an image and embeds it
+type rowReader interface {
+	// readRow reads row y of the image, the pixels across its whole width, 4 bytes per pixel.
+	// The row must not be modified or kept after the call.
+	readRow(y int, row []uint8)
+	// vector returns the vector of the image once all its rows are read
+	vector() (Vector, error)
+}
+
+// embedRows embeds the image with the rowEmbedder
+func embedRows(e rowEmbedder, img *pixels) (Vector, error) {
+	r, err := e.rowReader(img)
+	if err != nil {
+		return nil, err
+	}
+	readRows(img, r)
+	return r.vector()
+}
+
+// readRows reads each row of the image once and passes it to all the readers
+func readRows(img *pixels, readers ...rowReader) {
+	if len(readers) == 0 {
+		return
+	}
+	b := img.bounds
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.row(y, b.Min.X, b.Max.X)
+		for _, r := range readers {
+			r.readRow(y, row)
+		}
+	}
+}
+
+// Embed embeds the image with the embedder. It's the same as e.Img2Vec(ImageToRGBA(img)), but the embedders
+// of this package, except for the ones that transform the image, read *image.YCbCr, *image.Gray, *image.NRGBA and
+// *image.Paletted images directly, without allocating a full-size *image.RGBA copy of the image.
+func Embed(e ImageEmbedder, img image.Image) (Vector, error) {
+	if pe, ok := e.(pixelsEmbedder); ok && img != nil {
+		if p, ok := readPixels(img); ok {
+			return pe.embed(p)
+		}
+	}
+	return e.Img2Vec(ImageToRGBA(img))
+}
+
+// pixels reads the rows of an image as alpha-premultiplied RGBA pixels, exactly the ones ImageToRGBA
+// would convert the image to, one row at a time
+type pixels struct {
+	img    image.Image
+	bounds image.Rectangle
+	rgba   *image.RGBA // the image itself, or its copy once toRGBA is called
+	// palette is the palette of *image.Paletted images converted to RGBA
+	palette [256][4]uint8
+	buf     []uint8
+}
+
+// pixelsOf returns the pixels of the *image.RGBA image, or nil if the image is nil
+func pixelsOf(img *image.RGBA) *pixels {
+	if img == nil {
+		return nil
+	}
+	return &pixels{img: img, bounds: img.Bounds(), rgba: img}
+}
+
+// readPixels returns the pixels of the image, ok is false if the type of the image isn't supported
+func readPixels(img image.Image) (p *pixels, ok bool) {
+	switch img := img.(type) {
+	case *image.RGBA:
+		return pixelsOf(img), true
+	case *image.NRGBA, *image.Gray:
+	case *image.YCbCr:
+		// The same subsample ratios as image/draw converts with color.YCbCrToRGB, the others are rounded differently
+		switch img.SubsampleRatio {
+		case image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio422,
+			image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio440:
+		default:
+			return nil, false
+		}
+		// The decoders never return images with negative coordinates, whose chroma samples are paired differently
+		if img.Rect.Min.X < 0 {
+			return nil, false
+		}
+	case *image.Paletted:
+		p = &pixels{img: img, bounds: img.Bounds()}
+		for i, c := range img.Palette {
+			if i >= len(p.palette) {
+				break
+			}
+			r, g, b, a := c.RGBA()
+			p.palette[i] = [4]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+		}
+		return p, true
+	default:
+		return nil, false
+	}
+	return &pixels{img: img, bounds: img.Bounds()}, true
+}
+
+// empty reports whether there are no pixels to read
+func (p *pixels) empty() bool {
+	return p == nil || p.bounds.Empty()
+}
+
+// row returns the pixels of row y in range [minX..maxX), 4 bytes per pixel.
+// The returned slice is only valid until the next call of row.
+func (p *pixels) row(y, minX, maxX int) []uint8 {
+	if p.rgba != nil {
+		return p.rgba.Pix[p.rgba.PixOffset(minX, y):p.rgba.PixOffset(maxX, y)]
+	}
+	n := (maxX - minX) * 4
+	if cap(p.buf) < n {
+		p.buf = make([]uint8, n)
+	}
+	dst := p.buf[:n]
+	switch img := p.img.(type) {
+	case *image.NRGBA:
+		src := img.Pix[img.PixOffset(minX, y):img.PixOffset(maxX, y)]
+		for i := 0; i < n; i += 4 {
+			// The same conversion to alpha-premultiplied colors as image/draw does
+			s := src[i : i+4 : i+4]
+			sa := uint32(s[3]) * 0x101
+			d := dst[i : i+4 : i+4]
+			d[0] = uint8(uint32(s[0]) * sa / 0xff >> 8)
+			d[1] = uint8(uint32(s[1]) * sa / 0xff >> 8)
+			d[2] = uint8(uint32(s[2]) * sa / 0xff >> 8)
+			d[3] = s[3]
+		}
+	case *image.Gray:
+		src := img.Pix[img.PixOffset(minX, y):img.PixOffset(maxX, y)]
+		for i, v := range src {
+			d := dst[i*4 : i*4+4 : i*4+4]
+			d[0], d[1], d[2], d[3] = v, v, v, 0xff
+		}
+	case *image.YCbCr:
+		// The chroma samples of the row are found once, not with COffset per pixel. The pixels come in pairs
+		// sharing the chroma samples if they are subsampled horizontally, readPixels ensures x isn't negative.
+		shift, odd := 0, 0
+		if img.SubsampleRatio == image.YCbCrSubsampleRatio422 || img.SubsampleRatio == image.YCbCrSubsampleRatio420 {
+			shift, odd = 1, minX&1
+		}
+		ys := img.Y[img.YOffset(minX, y):img.YOffset(maxX, y)]
+		ci := img.COffset(minX, y)
+		last := (len(ys) - 1 + odd) >> shift
+		cbs := img.Cb[ci : ci+last+1]
+		crs := img.Cr[ci : ci+last+1]
+		dst = dst[:len(ys)*4]
+		for i, yy := range ys {
+			c := (i + odd) >> shift
+			// The same arithmetic as color.YCbCrToRGB, which isn't inlined
+			yy1 := int32(yy) * 0x10101
+			cb1 := int32(cbs[c]) - 128
+			cr1 := int32(crs[c]) - 128
+			d := dst[i*4 : i*4+4 : i*4+4]
+			d[0] = clampChannel(yy1 + 91881*cr1)
+			d[1] = clampChannel(yy1 - 22554*cb1 - 46802*cr1)
+			d[2] = clampChannel(yy1 + 116130*cb1)
+			d[3] = 0xff
+		}
+	case *image.Paletted:
+		src := img.Pix[img.PixOffset(minX, y):img.PixOffset(maxX, y)]
+		for i, v := range src {
+			copy(dst[i*4:i*4+4], p.palette[v][:])
+		}
+	}
+	return dst
+}
+
+// toRGBA returns the image converted to *image.RGBA, for the embedders that don't read it through pixels
+func (p *pixels) toRGBA() *image.RGBA {
+	if p == nil {
+		return nil
+	}
+	if p.rgba == nil {
+		p.rgba = ImageToRGBA(p.img)
+		p.bounds = p.rgba.Bounds()
+	}
+	return p.rgba
+}
+
+// clampChannel converts a 16.16 fixed-point channel value to uint8, clamping it to [0..255]
+func clampChannel(v int32) uint8 {
+	if uint32(v)&0xff000000 == 0 {
+		return uint8(v >> 16)
+	}
+	return uint8(^(v >> 31))
+}
@@ -0,0 +1,107 @@
+package embedders_test
+
+import (
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"os"
+	"testing"
+
+	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
+)
+
+// decodeFile returns the image from the file as it's decoded, without converting it to *image.RGBA
+func decodeFile(t testing.TB, filePath string) image.Image {
+	f, err := os.Open(filePath)
+	assert.NoError(t, err)
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	assert.NoError(t, err)
+	return img
+}
+
+// imagesOfAllTypes returns copies of the image of the types Embed reads directly, and of some other types
+func imagesOfAllTypes(t testing.TB, img image.Image) map[string]image.Image {
+	b := img.Bounds()
+	res := map[string]image.Image{}
+	for name, dst := range map[string]draw.Image{
+		"RGBA":     image.NewRGBA(b),
+		"NRGBA":    image.NewNRGBA(b),
+		"Gray":     image.NewGray(b),
+		"Paletted": image.NewPaletted(b, palette.Plan9),
+		"RGBA64":   image.NewRGBA64(b),
+	} {
+		draw.Draw(dst, b, img, b.Min, draw.Src)
+		res[name] = dst
+	}
+	for _, ratio := range []image.YCbCrSubsampleRatio{image.YCbCrSubsampleRatio444, image.YCbCrSubsampleRatio422,
+		image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio440, image.YCbCrSubsampleRatio411} {
+		ycbcr := image.NewYCbCr(b, ratio)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, _ := img.At(x, y).RGBA()
+				yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+				ycbcr.Y[ycbcr.YOffset(x, y)] = yy
+				ycbcr.Cb[ycbcr.COffset(x, y)] = cb
+				ycbcr.Cr[ycbcr.COffset(x, y)] = cr
+			}
+		}
+		res["YCbCr"+ratio.String()] = ycbcr
+	}
+	return res
+}
+
+func TestEmbed(t *testing.T) {
+	// A semi-transparent image, with an origin other than (0, 0)
+	src := image.NewNRGBA(image.Rect(10, 20, 110, 90))
+	for y := src.Rect.Min.Y; y < src.Rect.Max.Y; y++ {
+		for x := src.Rect.Min.X; x < src.Rect.Max.X; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 3), G: uint8(y * 5), B: uint8(x * y), A: uint8(255 - x)})
+		}
+	}
+	jpeg := decodeFile(t, "testdata/lena.jpeg")
+	all := []embedders.ImageEmbedder{
+		embedders.NewLowResolutionEmbedder(8, 8),
+		embedders.NewColorDispersionEmbedder(),
+		embedders.NewAspectRatioEmbedder(),
+		embedders.NewPHashEmbedder(8),
+		embedders.NewAHashEmbedder(8),
+		embedders.NewDHashEmbedder(8),
+		embedders.NewWHashEmbedder(8, 2),
+		embedders.NewColorHistogramEmbedder(embedders.HSV, 8, 3, 3),
+		embedders.NewHOGEmbedder(4, 4, 9),
+		embedders.NewDihedralInvariantEmbedder(embedders.NewLowResolutionEmbedder(4, 4)),
+	}
+	all = append(all, embedders.Composition(all))
+	images := map[string]image.Image{}
+	for name, img := range imagesOfAllTypes(t, src) {
+		images[name] = img
+		// The sub-images start at odd coordinates, so they start in the middle of subsampled chroma samples
+		images[name+" sub-image"] = img.(interface {
+			SubImage(r image.Rectangle) image.Image
+		}).SubImage(image.Rect(13, 21, 101, 87))
+	}
+	for name, img := range images {
+		for _, e := range all {
+			expected, err := e.Img2Vec(embedders.ImageToRGBA(img))
+			assert.NoError(t, err)
+			vec, err := embedders.Embed(e, img)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, vec, "%s %T", name, e)
+		}
+	}
+	for _, e := range all {
+		expected, err := e.Img2Vec(embedders.ImageToRGBA(jpeg))
+		assert.NoError(t, err)
+		vec, err := embedders.Embed(e, jpeg)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, vec, "JPEG %T", e)
+	}
+
+	_, err := embedders.Embed(embedders.NewPHashEmbedder(8), nil)
+	assert.ErrorIs(t, err, embedders.ErrEmptyImage)
+	_, err = embedders.Embed(embedders.NewPHashEmbedder(8), image.NewGray(image.Rect(0, 0, 0, 0)))
+	assert.ErrorIs(t, err, embedders.ErrEmptyImage)
+}
@@ -0,0 +1,120 @@
+package embedders
+
+import (
+	"fmt"
+	"image"
+)
+
+// Preprocessor transforms an image before it's embedded, e.g. normalises its colors or crops it.
+// It must not modify the image, it returns a new image or the image itself.
+type Preprocessor interface {
+	Preprocess(*image.RGBA) (*image.RGBA, error)
+}
+
+type pipelinePreprocessor struct {
+	Preprocessors []Preprocessor
+}
+
+// Pipeline returns a preprocessor that applies the given preprocessors one after another
+func Pipeline(preprocessors []Preprocessor) Preprocessor {
+	return pipelinePreprocessor{Preprocessors: preprocessors}
+}
+
+func (p pipelinePreprocessor) Preprocess(img *image.RGBA) (*image.RGBA, error) {
+	for _, pp := range p.Preprocessors {
+		var err error
+		if img, err = pp.Preprocess(img); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+type preprocessingEmbedder struct {
+	Preprocessor Preprocessor
+	Embedder     ImageEmbedder
+}
+
+// NewPreprocessingEmbedder returns an embedder that preprocesses the image before the given embedder embeds it.
+// With a Pipeline of preprocessors and a Composition of embedders, the image is preprocessed once for all of them:
+//
+//	embedders.NewPreprocessingEmbedder(
+//		embedders.Pipeline([]embedders.Preprocessor{
+//			embedders.NewBorderTrimPreprocessor(0.2, 8),
+//			embedders.NewResizePreprocessor(256),
+//			embedders.NewGammaPreprocessor(),
+//		}),
+//		embedders.Composition([]embedders.ImageEmbedder{...}),
+//	)
+func NewPreprocessingEmbedder(preprocessor Preprocessor, embedder ImageEmbedder) ImageEmbedder {
+	return preprocessingEmbedder{Preprocessor: preprocessor, Embedder: embedder}
+}
+
+func (e preprocessingEmbedder) Dims() int {
+	return e.Embedder.Dims()
+}
+
+func (e preprocessingEmbedder) Img2Vec(img *image.RGBA) (Vector, error) {
+	if img == nil || img.Bounds().Empty() {
+		return nil, ErrEmptyImage
+	}
+	img, err := e.Preprocessor.Preprocess(img)
+	if err != nil {
+		return nil, fmt.Errorf("failed to preprocess image: %w", err)
+	}
+	return e.Embedder.Img2Vec(img)
+}
+
+// Variants preprocesses the image and returns the vectors of its variants if the given embedder
+// is a VariantEmbedder, otherwise the vector of the preprocessed image only
+func (e preprocessingEmbedder) Variants(img *image.RGBA) ([]Vector, error) {
+	ve, ok := e.Embedder.(VariantEmbedder)
+	if !ok {
+		vec, err := e.Img2Vec(img)
+		if err != nil {
+			return nil, err
+		}
+		return []Vector{vec}, nil
+	}
+	if img == nil || img.Bounds().Empty() {
+		return nil, ErrEmptyImage
+	}
+	img, err := e.Preprocessor.Preprocess(img)
+	if err != nil {
+		return nil, fmt.Errorf("failed to preprocess image: %w", err)
+	}
+	return ve.Variants(img)
+}
+
+type grayscalePreprocessor struct{}
+
+// NewGrayscalePreprocessor returns a preprocessor that converts the colors of an image to shades of gray
+// of the same luma, keeping the alpha channel
+func NewGrayscalePreprocessor() Preprocessor {
+	return grayscalePreprocessor{}
+}
+
+func (p grayscalePreprocessor) Preprocess(img *image.RGBA) (*image.RGBA, error) {
+	if img == nil || img.Bounds().Empty() {
+		return nil, ErrEmptyImage
+	}
+	b := img.Bounds()
+	res := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			s := img.Pix[i : i+4 : i+4]
+			// The luma of alpha-premultiplied colors is alpha-premultiplied too
+			l := luma(s[0], s[1], s[2])
+			j := res.PixOffset(x-b.Min.X, y-b.Min.Y)
+			d := res.Pix[j : j+4 : j+4]
+			d[0], d[1], d[2], d[3] = l, l, l, s[3]
+		}
+	}
+	return res, nil
+}
+
+// luma returns the ITU-R BT.601 luma of the color, the same as color.GrayModel uses
+func luma(r, g, b uint8) uint8 {
+	return uint8((299*int(r) + 587*int(g) + 114*int(b) + 500) / 1000)
+}
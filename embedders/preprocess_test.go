@@ -0,0 +1,142 @@
+package embedders_test
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
+)
+
+// mapLevels returns a copy of the opaque image with f applied to the levels of its color channels
+func mapLevels(img *image.RGBA, f func(float64) float64) *image.RGBA {
+	res := image.NewRGBA(img.Bounds())
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			m := func(v uint8) uint8 { return uint8(math.Round(255 * f(float64(v)/255))) }
+			res.SetRGBA(x, y, color.RGBA{R: m(c.R), G: m(c.G), B: m(c.B), A: c.A})
+		}
+	}
+	return res
+}
+
+func TestPipeline(t *testing.T) {
+	img := createTestImage(200, 100)
+	framed := addBorders(img, 20, 10, color.White)
+	p := embedders.Pipeline([]embedders.Preprocessor{
+		embedders.NewBorderTrimPreprocessor(0, 1),
+		embedders.NewResizePreprocessor(100),
+	})
+	res, err := p.Preprocess(framed)
+	assert.NoError(t, err)
+	// The white quadrant is trimmed as well as the frame, as it's attached to it
+	assert.Equal(t, image.Rect(0, 0, 100, 50), res.Bounds())
+	assert.Equal(t, color.RGBA{A: 0xff}, res.RGBAAt(99, 0))
+
+	e := embedders.NewPreprocessingEmbedder(p, embedders.Composition([]embedders.ImageEmbedder{
+		embedders.NewAspectRatioEmbedder(),
+		embedders.NewLowResolutionEmbedder(4, 4),
+	}))
+	assert.Equal(t, 65, e.Dims())
+	vec, err := e.Img2Vec(framed)
+	assert.NoError(t, err)
+	assert.Equal(t, 65, len(vec))
+
+	_, err = embedders.NewPreprocessingEmbedder(embedders.Pipeline([]embedders.Preprocessor{
+		embedders.NewGrayscalePreprocessor(),
+		embedders.NewResizePreprocessor(0),
+	}), embedders.NewAspectRatioEmbedder()).Img2Vec(img)
+	assert.ErrorContains(t, err, "failed to preprocess image")
+	_, err = e.Img2Vec(nil)
+	assert.ErrorIs(t, err, embedders.ErrEmptyImage)
+}
+
+func TestGrayscalePreprocessor(t *testing.T) {
+	res, err := embedders.NewGrayscalePreprocessor().Preprocess(createTestImage(10, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, color.RGBA{R: 255, G: 255, B: 255, A: 255}, res.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{R: 76, G: 76, B: 76, A: 255}, res.RGBAAt(0, 9))
+	assert.Equal(t, color.RGBA{R: 75, G: 75, B: 75, A: 127}, res.RGBAAt(9, 9))
+}
+
+func TestResizePreprocessor(t *testing.T) {
+	img := createTestImage(200, 100)
+	res, err := embedders.NewResizePreprocessor(100).Preprocess(img)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 100, 50), res.Bounds())
+	for _, p := range []image.Point{{0, 0}, {99, 0}, {0, 49}, {99, 49}} {
+		assert.Equal(t, img.RGBAAt(p.X*2, p.Y*2), res.RGBAAt(p.X, p.Y))
+	}
+	res, err = embedders.NewResizePreprocessor(10).Preprocess(createTestImage(40, 400))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 1, 10), res.Bounds())
+	// The smaller images are kept as they are
+	res, err = embedders.NewResizePreprocessor(200).Preprocess(img)
+	assert.NoError(t, err)
+	assert.Same(t, img, res)
+}
+
+func TestTonePreprocessors(t *testing.T) {
+	orig, err := loadImage("../testdata/pokemon/abomasnow.png")
+	assert.NoError(t, err)
+	e := embedders.NewLowResolutionEmbedder(8, 8)
+	for name, tc := range map[string]struct {
+		preprocessor embedders.Preprocessor
+		copy         *image.RGBA
+	}{
+		"gamma":    {embedders.NewGammaPreprocessor(), adjustGamma(orig, 0.5)},
+		"contrast": {embedders.NewContrastPreprocessor(), mapLevels(orig, func(v float64) float64 { return 0.2 + 0.6*v })},
+		"equalization": {embedders.NewHistogramEqualizationPreprocessor(),
+			mapLevels(orig, func(v float64) float64 { return math.Sqrt(v) * 0.8 })},
+	} {
+		raw := func(img *image.RGBA) embedders.Vector {
+			vec, err := e.Img2Vec(img)
+			assert.NoError(t, err)
+			return vec
+		}
+		preprocessed := func(img *image.RGBA) embedders.Vector {
+			vec, err := embedders.NewPreprocessingEmbedder(tc.preprocessor, e).Img2Vec(img)
+			assert.NoError(t, err)
+			return vec
+		}
+		before := raw(orig).Distance(raw(tc.copy))
+		after := preprocessed(orig).Distance(preprocessed(tc.copy))
+		assert.Less(t, after, before/4, name)
+	}
+}
+
+func TestTonePreprocessorsTransparency(t *testing.T) {
+	img := createTestImage(10, 10)
+	for _, p := range []embedders.Preprocessor{
+		embedders.NewGammaPreprocessor(),
+		embedders.NewContrastPreprocessor(),
+		embedders.NewHistogramEqualizationPreprocessor(),
+	} {
+		res, err := p.Preprocess(img)
+		assert.NoError(t, err)
+		for y := 0; y < 10; y++ {
+			for x := 0; x < 10; x++ {
+				c := res.RGBAAt(x, y)
+				assert.Equal(t, img.RGBAAt(x, y).A, c.A)
+				assert.LessOrEqual(t, c.G, c.A)
+			}
+		}
+		_, err = p.Preprocess(nil)
+		assert.ErrorIs(t, err, embedders.ErrEmptyImage)
+	}
+
+	// There is no contrast to stretch in a flat image
+	flat := createMonochromeImage(5, 5)
+	for _, p := range []embedders.Preprocessor{
+		embedders.NewContrastPreprocessor(),
+		embedders.NewHistogramEqualizationPreprocessor(),
+	} {
+		res, err := p.Preprocess(flat)
+		assert.NoError(t, err)
+		assert.Equal(t, flat, res)
+	}
+}
@@ -0,0 +1,51 @@
+package embedders
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+type resizePreprocessor struct {
+	MaxSide int
+}
+
+// NewResizePreprocessor returns a preprocessor that downscales an image, keeping its aspect ratio, so that its
+// longer side is maxSide pixels. Each pixel of the result is the average of the pixels it covers.
+// The smaller images are kept as they are. Downscaling large images first speeds up the other preprocessors
+// and the embedders, and makes the images of different resolutions alike.
+func NewResizePreprocessor(maxSide int) Preprocessor {
+	return resizePreprocessor{MaxSide: maxSide}
+}
+
+func (p resizePreprocessor) Preprocess(img *image.RGBA) (*image.RGBA, error) {
+	if p.MaxSide <= 0 {
+		return nil, fmt.Errorf("resizePreprocessor's MaxSide parameter must be greater than 0")
+	}
+	if img == nil || img.Bounds().Empty() {
+		return nil, ErrEmptyImage
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= p.MaxSide && h <= p.MaxSide {
+		return img, nil
+	}
+	width, height := p.MaxSide, p.MaxSide
+	if w > h {
+		height = int(math.Max(1, math.Round(float64(h*p.MaxSide)/float64(w))))
+	} else {
+		width = int(math.Max(1, math.Round(float64(w*p.MaxSide)/float64(h))))
+	}
+	cells := newCellAverages(b, width, height)
+	readRows(pixelsOf(img), cells)
+	avg, err := cells.vector()
+	if err != nil {
+		return nil, err
+	}
+	// The averages are in the same order as the pixels of the result
+	res := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i, v := range avg {
+		res.Pix[i] = uint8(math.Round(v * 255))
+	}
+	return res, nil
+}
@@ -0,0 +1,160 @@
+package embedders
+
+import (
+	"image"
+	"math"
+)
+
+// contrastClip is the fraction of the darkest and of the brightest pixels contrastPreprocessor ignores,
+// so a few outliers, such as compression artifacts, don't prevent the contrast from being stretched
+const contrastClip = 0.01
+
+// toneCurve maps the levels of the color channels
+type toneCurve [256]uint8
+
+type gammaPreprocessor struct{}
+
+// NewGammaPreprocessor returns a preprocessor that applies the gamma correction to an image,
+// so that its mean luma is in the middle of the range. It makes the images with different gamma alike.
+func NewGammaPreprocessor() Preprocessor {
+	return gammaPreprocessor{}
+}
+
+func (p gammaPreprocessor) Preprocess(img *image.RGBA) (*image.RGBA, error) {
+	hist, total, err := lumaHistogram(img)
+	if err != nil || total == 0 {
+		return img, err
+	}
+	var sum float64
+	for level, n := range hist {
+		sum += float64(level * n)
+	}
+	mean := sum / float64(total) / 255
+	if mean <= 0 || mean >= 1 {
+		return img, nil
+	}
+	gamma := math.Log(0.5) / math.Log(mean)
+	var curve toneCurve
+	for level := range curve {
+		curve[level] = uint8(math.Round(255 * math.Pow(float64(level)/255, gamma)))
+	}
+	return curve.apply(img), nil
+}
+
+type contrastPreprocessor struct{}
+
+// NewContrastPreprocessor returns a preprocessor that stretches the contrast of an image linearly,
+// so that its luma spans the whole range. It makes the washed-out and the contrasty copies of an image alike.
+func NewContrastPreprocessor() Preprocessor {
+	return contrastPreprocessor{}
+}
+
+func (p contrastPreprocessor) Preprocess(img *image.RGBA) (*image.RGBA, error) {
+	hist, total, err := lumaHistogram(img)
+	if err != nil || total == 0 {
+		return img, err
+	}
+	clip := int(float64(total) * contrastClip)
+	low, high := 0, 255
+	for n := hist[low]; n <= clip && low < 255; n += hist[low] {
+		low++
+	}
+	for n := hist[high]; n <= clip && high > 0; n += hist[high] {
+		high--
+	}
+	if high <= low {
+		return img, nil
+	}
+	var curve toneCurve
+	for level := range curve {
+		v := math.Round(float64(level-low) * 255 / float64(high-low))
+		curve[level] = uint8(math.Max(0, math.Min(255, v)))
+	}
+	return curve.apply(img), nil
+}
+
+type histogramEqualizationPreprocessor struct{}
+
+// NewHistogramEqualizationPreprocessor returns a preprocessor that equalizes the histogram of an image,
+// so that its luma levels are used evenly. Unlike NewContrastPreprocessor, it changes the contrast non-linearly,
+// making the images alike even when their tones were changed by different curves.
+func NewHistogramEqualizationPreprocessor() Preprocessor {
+	return histogramEqualizationPreprocessor{}
+}
+
+func (p histogramEqualizationPreprocessor) Preprocess(img *image.RGBA) (*image.RGBA, error) {
+	hist, total, err := lumaHistogram(img)
+	if err != nil || total == 0 {
+		return img, err
+	}
+	var cdf [256]int
+	sum := 0
+	for level, n := range hist {
+		sum += n
+		cdf[level] = sum
+	}
+	// The darkest level stays black
+	minCDF := 0
+	for _, c := range cdf {
+		if c > 0 {
+			minCDF = c
+			break
+		}
+	}
+	if total == minCDF {
+		return img, nil
+	}
+	var curve toneCurve
+	for level := range curve {
+		v := math.Round(float64(cdf[level]-minCDF) * 255 / float64(total-minCDF))
+		curve[level] = uint8(math.Max(0, v))
+	}
+	return curve.apply(img), nil
+}
+
+// lumaHistogram returns the number of pixels of the image with each level of luma, and the number of the pixels
+// counted. The fully transparent pixels are not counted.
+func lumaHistogram(img *image.RGBA) (hist [256]int, total int, err error) {
+	if img == nil || img.Bounds().Empty() {
+		return hist, 0, ErrEmptyImage
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			s := img.Pix[i : i+4 : i+4]
+			if s[3] == 0 {
+				continue
+			}
+			hist[unpremultiply(luma(s[0], s[1], s[2]), s[3])]++
+			total++
+		}
+	}
+	return hist, total, nil
+}
+
+// apply returns a copy of the image with the curve applied to the color channels of each pixel
+func (c *toneCurve) apply(img *image.RGBA) *image.RGBA {
+	b := img.Bounds()
+	res := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			s := img.Pix[i : i+4 : i+4]
+			j := res.PixOffset(x-b.Min.X, y-b.Min.Y)
+			d := res.Pix[j : j+4 : j+4]
+			switch a := s[3]; a {
+			case 0:
+			case 0xff:
+				d[0], d[1], d[2], d[3] = c[s[0]], c[s[1]], c[s[2]], a
+			default:
+				// The curve maps the levels of the colors, not of the alpha-premultiplied ones
+				for ch := 0; ch < 3; ch++ {
+					d[ch] = uint8((int(c[unpremultiply(s[ch], a)])*int(a) + 127) / 255)
+				}
+				d[3] = a
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,103 @@
+package embedders
+
+import (
+	"fmt"
+	"image"
+)
+
+// TrimBorders crops the uniform borders off the image, such as frames and letterbox bars, and returns
+// the sub-image within them, which shares the pixels with the image.
+//
+// The borders are peeled off line by line from all the sides, so the nested frames of different colors are
+// cropped as well. A line is uniform if none of the channels of its pixels differs from the average of
+// the line by more than tolerance, which is in range [0..1]; a tolerance above 0 accounts for compression
+// artifacts. If what's left within the borders is narrower or lower than minSide pixels, or the image is uniform
+// as a whole, e.g. of a solid color, there is nothing to crop the borders off, and the image is returned as is.
+func TrimBorders(img *image.RGBA, tolerance float64, minSide int) *image.RGBA {
+	if img == nil || img.Bounds().Empty() {
+		return img
+	}
+	maxDiff := int(tolerance * 255)
+	r := img.Bounds()
+	for trimmed := true; trimmed; {
+		trimmed = false
+		if r.Dy() > 1 && isUniform(img, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+1), maxDiff) {
+			r.Min.Y++
+			trimmed = true
+		}
+		if r.Dy() > 1 && isUniform(img, image.Rect(r.Min.X, r.Max.Y-1, r.Max.X, r.Max.Y), maxDiff) {
+			r.Max.Y--
+			trimmed = true
+		}
+		if r.Dx() > 1 && isUniform(img, image.Rect(r.Min.X, r.Min.Y, r.Min.X+1, r.Max.Y), maxDiff) {
+			r.Min.X++
+			trimmed = true
+		}
+		if r.Dx() > 1 && isUniform(img, image.Rect(r.Max.X-1, r.Min.Y, r.Max.X, r.Max.Y), maxDiff) {
+			r.Max.X--
+			trimmed = true
+		}
+	}
+	if r.Dx() < minSide || r.Dy() < minSide || isUniform(img, r, maxDiff) {
+		return img
+	}
+	return img.SubImage(r).(*image.RGBA)
+}
+
+// isUniform reports whether no channel of the pixels of the line differs from its average by more than maxDiff
+func isUniform(img *image.RGBA, line image.Rectangle, maxDiff int) bool {
+	var sum [4]int
+	for y := line.Min.Y; y < line.Max.Y; y++ {
+		for x := line.Min.X; x < line.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			for c, v := range img.Pix[i : i+4 : i+4] {
+				sum[c] += int(v)
+			}
+		}
+	}
+	n := line.Dx() * line.Dy()
+	for y := line.Min.Y; y < line.Max.Y; y++ {
+		for x := line.Min.X; x < line.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			for c, v := range img.Pix[i : i+4 : i+4] {
+				if d := int(v)*n - sum[c]; d > maxDiff*n || -d > maxDiff*n {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+type borderTrimPreprocessor struct {
+	Tolerance float64
+	MinSide   int
+}
+
+// NewBorderTrimPreprocessor returns a preprocessor that crops the uniform borders off an image with TrimBorders.
+// tolerance is in range [0..1], 0.2 is a good start for JPEG images. minSide must be no less than the smallest
+// image the embedders accept, e.g. 8 for NewLowResolutionEmbedder(8, 8): the images with less content within
+// the borders are kept as they are.
+func NewBorderTrimPreprocessor(tolerance float64, minSide int) Preprocessor {
+	return borderTrimPreprocessor{Tolerance: tolerance, MinSide: minSide}
+}
+
+func (p borderTrimPreprocessor) Preprocess(img *image.RGBA) (*image.RGBA, error) {
+	if p.Tolerance < 0 || p.Tolerance > 1 {
+		return nil, fmt.Errorf("borderTrimPreprocessor's Tolerance parameter must be in range [0..1]")
+	}
+	if p.MinSide <= 0 {
+		return nil, fmt.Errorf("borderTrimPreprocessor's MinSide parameter must be greater than 0")
+	}
+	if img == nil || img.Bounds().Empty() {
+		return nil, ErrEmptyImage
+	}
+	return TrimBorders(img, p.Tolerance, p.MinSide), nil
+}
+
+// NewBorderTrimmingEmbedder returns an embedder that crops the uniform borders off the image with TrimBorders
+// before the given embedder embeds it, so a framed or letterboxed copy of an image is close to the image itself.
+// It's a shorthand for NewPreprocessingEmbedder(NewBorderTrimPreprocessor(tolerance, minSide), embedder).
+func NewBorderTrimmingEmbedder(embedder ImageEmbedder, tolerance float64, minSide int) ImageEmbedder {
+	return NewPreprocessingEmbedder(NewBorderTrimPreprocessor(tolerance, minSide), embedder)
+}
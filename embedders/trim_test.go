@@ -0,0 +1,114 @@
+package embedders_test
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
+)
+
+// addBorders returns a copy of the image with the borders of the given color and widths added around it
+func addBorders(img *image.RGBA, horizontal, vertical int, c color.Color) *image.RGBA {
+	b := img.Bounds()
+	res := image.NewRGBA(image.Rect(0, 0, b.Dx()+2*horizontal, b.Dy()+2*vertical))
+	draw.Draw(res, res.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	draw.Draw(res, image.Rect(horizontal, vertical, horizontal+b.Dx(), vertical+b.Dy()), img, b.Min, draw.Src)
+	return res
+}
+
+func TestTrimBorders(t *testing.T) {
+	img := createTestImage(40, 20)
+	framed := addBorders(addBorders(img, 3, 0, color.Black), 2, 5, color.RGBA{R: 10, G: 200, B: 30, A: 255})
+	trimmed := embedders.TrimBorders(framed, 0, 1)
+	assert.Equal(t, image.Rect(5, 5, 45, 25), trimmed.Bounds())
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			assert.Equal(t, img.RGBAAt(x, y), trimmed.RGBAAt(x+5, y+5))
+		}
+	}
+
+	// The noise in the corner stops trimming of the top and left borders, unless it's within the tolerance
+	noisy := addBorders(img, 4, 4, color.White)
+	noisy.SetRGBA(0, 0, color.RGBA{R: 230, G: 240, B: 250, A: 255})
+	assert.Equal(t, image.Rect(0, 0, 44, 24), embedders.TrimBorders(noisy, 0, 1).Bounds())
+	assert.Equal(t, image.Rect(4, 4, 44, 24), embedders.TrimBorders(noisy, 0.1, 1).Bounds())
+
+	// The image is kept as is if there is no content within the borders, or it's smaller than minSide
+	monochrome := createMonochromeImage(10, 10)
+	assert.Equal(t, monochrome, embedders.TrimBorders(monochrome, 0, 1))
+	assert.Equal(t, image.Rect(4, 4, 44, 24), embedders.TrimBorders(noisy, 0.1, 20).Bounds())
+	assert.Equal(t, noisy, embedders.TrimBorders(noisy, 0.1, 21))
+	assert.Nil(t, embedders.TrimBorders(nil, 0, 1))
+}
+
+func TestBorderTrimmingEmbedderSmallContent(t *testing.T) {
+	// The images the inner embedder accepts aren't trimmed below its minimum size
+	inner := embedders.Composition([]embedders.ImageEmbedder{
+		embedders.NewAspectRatioEmbedder(),
+		embedders.NewColorDispersionEmbedder(),
+		embedders.NewLowResolutionEmbedder(8, 8),
+	})
+	e := embedders.NewBorderTrimmingEmbedder(inner, 0.2, 8)
+	white := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	draw.Draw(white, white.Bounds(), image.White, image.Point{}, draw.Src)
+	dot := addBorders(createTestImage(5, 5), 100, 100, color.White)
+	for name, img := range map[string]*image.RGBA{"white": white, "dot": dot} {
+		expected, err := inner.Img2Vec(img)
+		assert.NoError(t, err, name)
+		vec, err := e.Img2Vec(img)
+		assert.NoError(t, err, name)
+		assert.Equal(t, expected, vec, name)
+	}
+}
+
+func TestTrimBordersFixtures(t *testing.T) {
+	// The frames and the scribbles on top of the image are kept inside the outer frames
+	img, err := loadImage("../testdata/distorted_abomasnow.jpg")
+	assert.NoError(t, err)
+	trimmed := embedders.TrimBorders(img, 0.2, 8).Bounds()
+	assert.True(t, trimmed.In(image.Rect(20, 25, 392, 330)), "%v is not within the frame", trimmed)
+	assert.Greater(t, trimmed.Dx(), 300)
+	assert.Greater(t, trimmed.Dy(), 250)
+
+	// The white background of the original is trimmed too, so its copies with any frames are close to it
+	orig, err := loadImage("../testdata/pokemon/abomasnow.png")
+	assert.NoError(t, err)
+	compressed, err := loadImage("../testdata/compressed_abomasnow.jpg")
+	assert.NoError(t, err)
+	inner := embedders.Composition([]embedders.ImageEmbedder{
+		embedders.NewAspectRatioEmbedder(),
+		embedders.NewColorDispersionEmbedder(),
+		embedders.NewLowResolutionEmbedder(8, 8),
+	})
+	e := embedders.NewBorderTrimmingEmbedder(inner, 0.2, 8)
+	assert.Equal(t, inner.Dims(), e.Dims())
+	origVec, err := e.Img2Vec(orig)
+	assert.NoError(t, err)
+	for name, copy := range map[string]*image.RGBA{
+		"letterboxed": addBorders(compressed, 0, 40, color.Black),
+		"framed":      addBorders(addBorders(compressed, 6, 6, color.White), 10, 10, color.Gray{Y: 128}),
+	} {
+		vec, err := e.Img2Vec(copy)
+		assert.NoError(t, err)
+		assert.Less(t, origVec.Distance(vec), 0.1, name)
+		vec, err = inner.Img2Vec(copy)
+		assert.NoError(t, err)
+		innerVec, err := inner.Img2Vec(orig)
+		assert.NoError(t, err)
+		assert.Greater(t, innerVec.Distance(vec), 1., name)
+	}
+	assertMatches(t, e, "../testdata/distorted_abomasnow.jpg", 3.5)
+}
+
+func TestBorderTrimmingEmbedderErrors(t *testing.T) {
+	e := embedders.NewBorderTrimmingEmbedder(embedders.NewAHashEmbedder(8), 0.1, 1)
+	_, err := e.Img2Vec(nil)
+	assert.ErrorIs(t, err, embedders.ErrEmptyImage)
+	_, err = embedders.NewBorderTrimmingEmbedder(embedders.NewAHashEmbedder(8), 1.5, 1).Img2Vec(createTestImage(10, 10))
+	assert.Error(t, err)
+	_, err = embedders.NewBorderTrimmingEmbedder(embedders.NewAHashEmbedder(8), 0.1, 0).Img2Vec(createTestImage(10, 10))
+	assert.Error(t, err)
+}
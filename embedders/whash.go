@@ -0,0 +1,100 @@
+package embedders
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+)
+
+// maxWHashThumbnailSide limits the side of the thumbnail wHashEmbedder decomposes
+const maxWHashThumbnailSide = 1024
+
+// wHashTolerance is the difference from the average of the block below which a pixel of the thumbnail
+// isn't considered brighter, so the rounding errors of uniform blocks don't set the bits
+const wHashTolerance = 1e-9
+
+type wHashEmbedder struct {
+	HashSize int
+	Level    int
+	Alpha    AlphaPolicy
+}
+
+// NewWHashEmbedder returns an embedder that calculates a wavelet hash of an image.
+//
+// The image is converted to grayscale and downsampled to a hashSize*hashSize thumbnail, then level steps
+// of the 2D Haar wavelet decomposition are applied to it. The approximation coefficients of the last step,
+// which are the averages of the blocks of 2^level*2^level pixels of the thumbnail, are removed, and the thumbnail
+// is reconstructed from the detail coefficients only, so each of its pixels becomes the difference between
+// the pixel and the average of its block. If hashSize isn't a power of 2, the blocks at the right and bottom
+// edges are smaller.
+// It produces vectors of hashSize*hashSize numbers, 1 for the pixels brighter than the average of their block
+// and 0 for the rest, so the distance between two vectors is the Hamming distance between the hashes.
+// The level sets the scale of the details the hash captures: with level=1 the pixels are compared to their
+// neighbours, with the maximum level, log2(hashSize) rounded up, they are compared to the average of the whole
+// thumbnail, as in the average hash. hashSize=8 and level=2 is a good start.
+// The alpha channel is ignored, the optional policy tells what the transparent pixels are.
+func NewWHashEmbedder(hashSize, level int, policy ...AlphaPolicy) ImageEmbedder {
+	return wHashEmbedder{HashSize: hashSize, Level: level, Alpha: alphaPolicy(policy)}
+}
+
+func (e wHashEmbedder) Dims() int {
+	return e.HashSize * e.HashSize
+}
+
+func (e wHashEmbedder) Img2Vec(img *image.RGBA) (Vector, error) {
+	return e.embed(pixelsOf(img))
+}
+
+func (e wHashEmbedder) embed(img *pixels) (Vector, error) {
+	return embedRows(e, img)
+}
+
+func (e wHashEmbedder) rowReader(img *pixels) (rowReader, error) {
+	if e.HashSize <= 0 || e.HashSize > maxWHashThumbnailSide {
+		return nil, fmt.Errorf("wHashEmbedder's HashSize parameter must be in range [1..%d]", maxWHashThumbnailSide)
+	}
+	// The levels after the one whose blocks cover the whole thumbnail would decompose nothing
+	maxLevel := bits.Len(uint(e.HashSize - 1))
+	if e.Level < 1 || e.Level > maxLevel {
+		return nil, fmt.Errorf("wHashEmbedder's Level parameter must be in range [1..%d] for HashSize %d",
+			maxLevel, e.HashSize)
+	}
+	if img.empty() {
+		return nil, ErrEmptyImage
+	}
+	return e.Alpha.reader(newThumbnailReader(img.bounds, e.HashSize, e.HashSize, e.hash)), nil
+}
+
+// hash removes the averages of the blocks from the thumbnail and binarizes what's left. Subtracting the averages
+// is the same as reconstructing the thumbnail without the approximation coefficients of the Haar decomposition.
+func (e wHashEmbedder) hash(gray []float64) Vector {
+	side, block := e.HashSize, 1<<e.Level
+	vec := make(Vector, e.Dims())
+	for minY := 0; minY < side; minY += block {
+		maxY := minY + block
+		if maxY > side {
+			maxY = side
+		}
+		for minX := 0; minX < side; minX += block {
+			maxX := minX + block
+			if maxX > side {
+				maxX = side
+			}
+			var sum float64
+			for y := minY; y < maxY; y++ {
+				for _, v := range gray[y*side+minX : y*side+maxX] {
+					sum += v
+				}
+			}
+			avg := sum / float64((maxY-minY)*(maxX-minX))
+			for y := minY; y < maxY; y++ {
+				for x := minX; x < maxX; x++ {
+					if gray[y*side+x]-avg > wHashTolerance {
+						vec[y*side+x] = 1
+					}
+				}
+			}
+		}
+	}
+	return vec
+}
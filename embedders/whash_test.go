@@ -0,0 +1,177 @@
+package embedders_test
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+
+	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWHashEmbedderImg2Vec(t *testing.T) {
+	type args struct {
+		img      *image.RGBA
+		hashSize int
+		level    int
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    embedders.Vector
+		wantErr bool
+	}{
+		{
+			"2*2 hash, 1 level",
+			args{createTestImage(100, 100), 2, 1},
+			// only white is brighter than the average of the whole image
+			embedders.Vector{1, 0, 0, 0},
+			false,
+		}, {
+			"4*4 hash, 1 level",
+			args{createTestImage(100, 100), 4, 1},
+			// the quadrants are uniform, so there are no details within the 2*2 blocks
+			make(embedders.Vector, 16),
+			false,
+		}, {
+			"4*4 hash, 2 levels",
+			args{createTestImage(100, 100), 4, 2},
+			embedders.Vector{
+				1, 1, 0, 0,
+				1, 1, 0, 0,
+				0, 0, 0, 0,
+				0, 0, 0, 0,
+			},
+			false,
+		}, {
+			"image smaller than the thumbnail",
+			args{createTestImage(2, 2), 4, 2},
+			embedders.Vector{
+				1, 1, 0, 0,
+				1, 1, 0, 0,
+				0, 0, 0, 0,
+				0, 0, 0, 0,
+			},
+			false,
+		}, {
+			"0x0 image",
+			args{createTestImage(0, 0), 2, 1},
+			nil,
+			true,
+		}, {
+			"wrong hash size",
+			args{createTestImage(100, 100), 0, 1},
+			nil,
+			true,
+		}, {
+			"no decomposition",
+			args{createTestImage(100, 100), 8, 0},
+			nil,
+			true,
+		}, {
+			"negative level",
+			args{createTestImage(100, 100), 8, -1},
+			nil,
+			true,
+		}, {
+			"too many levels",
+			args{createTestImage(100, 100), 8, 4},
+			nil,
+			true,
+		}, {
+			"levels overflowing the thumbnail side",
+			args{createTestImage(100, 100), 8, 60},
+			nil,
+			true,
+		}, {
+			"too large hash size",
+			args{createTestImage(100, 100), math.MaxInt, 1},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := embedders.NewWHashEmbedder(tt.args.hashSize, tt.args.level)
+			got, err := e.Img2Vec(tt.args.img)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Img2Vec() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWHashEmbedderLevels(t *testing.T) {
+	// Each 8*8 cell of the image is a pixel of the 8*8 thumbnail. The brightness of the cell is the sum of
+	// a step between the halves of the image, stripes two cells wide and a checkerboard, so the larger
+	// the blocks the hash compares the pixels within, the coarser the pattern it captures.
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			cx, cy := x/8, y/8
+			v := 50 + 25*((cx+cy)%2) + 50*(cx/2%2)
+			if cx >= 4 {
+				v += 100
+			}
+			img.Set(x, y, color.Gray{Y: uint8(v)})
+		}
+	}
+	checkerboard := embedders.Vector{}
+	stripes := embedders.Vector{}
+	halves := embedders.Vector{}
+	for y := 0; y < 8; y++ {
+		checkerboard = append(checkerboard, float64(y%2), float64(1-y%2), float64(y%2), float64(1-y%2),
+			float64(y%2), float64(1-y%2), float64(y%2), float64(1-y%2))
+		stripes = append(stripes, 0, 0, 1, 1, 0, 0, 1, 1)
+		halves = append(halves, 0, 0, 0, 0, 1, 1, 1, 1)
+	}
+	for level, want := range map[int]embedders.Vector{1: checkerboard, 2: stripes, 3: halves} {
+		vec, err := embedders.NewWHashEmbedder(8, level).Img2Vec(img)
+		assert.NoError(t, err)
+		assert.Equal(t, want, vec, "level %d", level)
+	}
+}
+
+func TestWHashEmbedderDims(t *testing.T) {
+	e := embedders.NewWHashEmbedder(8, 2)
+	vec, err := e.Img2Vec(createTestImage(100, 100))
+	assert.NoError(t, err)
+	assert.Equal(t, 64, e.Dims())
+	assert.Equal(t, e.Dims(), len(vec))
+	assertBinary(t, vec)
+}
+
+func TestWHashEmbedderRobustness(t *testing.T) {
+	e := embedders.NewWHashEmbedder(8, 2)
+	assertMatches(t, e, "../testdata/compressed_abomasnow.jpg", 2)
+
+	img, err := loadImage("../testdata/pokemon/abomasnow.png")
+	assert.NoError(t, err)
+	orig, err := e.Img2Vec(img)
+	assert.NoError(t, err)
+
+	// resized to a third
+	b := img.Bounds()
+	small := image.NewRGBA(image.Rect(0, 0, b.Dx()/3, b.Dy()/3))
+	for y := 0; y < small.Bounds().Dy(); y++ {
+		for x := 0; x < small.Bounds().Dx(); x++ {
+			small.Set(x, y, img.At(b.Min.X+x*3+1, b.Min.Y+y*3+1))
+		}
+	}
+	vec, err := e.Img2Vec(small)
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, orig.Distance(vec), 4.0, "resized image")
+
+	// watermarked in the corner
+	marked := image.NewRGBA(b)
+	draw.Draw(marked, b, img, b.Min, draw.Src)
+	draw.Draw(marked, image.Rect(b.Max.X-30, b.Max.Y-15, b.Max.X, b.Max.Y),
+		image.NewUniform(color.RGBA{R: 200, G: 200, B: 200, A: 255}), image.Point{}, draw.Over)
+	vec, err = e.Img2Vec(marked)
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, orig.Distance(vec), 4.0, "watermarked image")
+}
@@ -0,0 +1,90 @@
+package imgidx
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// exifOrientationTag is the ID of the EXIF tag with the orientation of the image
+const exifOrientationTag = 0x0112
+
+// jpegOrientation returns the value of the EXIF orientation tag of the JPEG image in range [1..8],
+// or 1, meaning the image is upright, if there is no valid tag.
+// The data is the beginning of the image, the tag is looked up in the APP1 segments before the image data.
+func jpegOrientation(data []byte) int {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 { // SOI
+		return 1
+	}
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xff {
+			return 1
+		}
+		marker := data[pos+1]
+		if marker == 0xff { // fill byte
+			pos++
+			continue
+		}
+		if marker == 0xda || (marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc) {
+			// The image data starts, the EXIF segment must precede it
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return 1
+		}
+		if marker == 0xe1 { // APP1
+			if o := exifOrientation(data[pos+4 : end]); o != 0 {
+				return o
+			}
+		}
+		pos = end
+	}
+	return 1
+}
+
+// exifOrientation returns the orientation tag from the APP1 segment, or 0 if it's not an EXIF segment
+// or there is no valid orientation tag in it
+func exifOrientation(segment []byte) int {
+	header := []byte("Exif\x00\x00")
+	if !bytes.HasPrefix(segment, header) || len(segment) < len(header)+8 {
+		return 0
+	}
+	tiff := segment[len(header):]
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 0
+	}
+	// The orientation is a tag of the first IFD, which is a list of 12-byte entries: tag, type, count and value
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		const short = 3
+		if order.Uint16(tiff[entry+2:]) != short {
+			return 0
+		}
+		if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+			return o
+		}
+		return 0
+	}
+	return 0
+}
@@ -0,0 +1,317 @@
+package imgidx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrImageTooLarge is returned if the image exceeds the size limits
+var ErrImageTooLarge = errors.New("image is too large")
+
+// ErrBlockedAddress is returned if the image URL points at an address the Fetcher is not allowed to connect to
+var ErrBlockedAddress = errors.New("address is blocked")
+
+const (
+	// defaultFetchTimeout is the timeout of the HTTP client used by the Fetcher unless another client is set
+	defaultFetchTimeout = 30 * time.Second
+	// maxRedirects is the number of redirects the Fetcher follows, the same as http.Client does by default
+	maxRedirects = 10
+)
+
+// DefaultFetcher is used by AddImageUrl, NearestByURL and the other helpers that download images.
+// It checks the images against DefaultDecodeLimits, so changing them changes its limits too.
+// It may be replaced with a Fetcher that has other limits.
+var DefaultFetcher = mustNewFetcher()
+
+// Fetcher downloads images over HTTP, checking them against the limits before decoding.
+//
+// By default, it allows http and https URLs of the images within DefaultDecodeLimits, decoded with
+// DefaultDecodeOptions, as they are at the time of the download, and it uses an HTTP client with a 30-second timeout.
+type Fetcher struct {
+	client *http.Client
+	// limits is nil unless the options set them, then DefaultDecodeLimits are used
+	limits *DecodeLimits
+	// decodeOpts is nil unless WithDecodeOptions sets them, then DefaultDecodeOptions are used
+	decodeOpts      *DecodeOptions
+	allowedSchemes  []string
+	blockPrivateIPs bool
+}
+
+// FetcherOption is an option of the Fetcher created by NewFetcher
+type FetcherOption func(*Fetcher)
+
+// WithHTTPClient makes the Fetcher send the requests with the client.
+func WithHTTPClient(client *http.Client) FetcherOption {
+	return func(f *Fetcher) {
+		f.client = client
+	}
+}
+
+// WithMaxDownloadSize sets the maximum size of a downloaded image in bytes, 0 means no limit.
+// Larger responses are not read to the end, and ErrImageTooLarge is returned.
+// The other limits are copied from DefaultDecodeLimits when the Fetcher is created, unless they are set too.
+func WithMaxDownloadSize(maxBytes int64) FetcherOption {
+	return func(f *Fetcher) {
+		f.ownLimits().MaxBytes = maxBytes
+	}
+}
+
+// WithMaxImageSize sets the maximum width and height of a downloaded image in pixels, 0 means no limit.
+// The dimensions are read from the image header, so larger images are rejected with ErrImageTooLarge
+// without being decoded.
+// The other limits are copied from DefaultDecodeLimits when the Fetcher is created, unless they are set too.
+func WithMaxImageSize(width, height int) FetcherOption {
+	return func(f *Fetcher) {
+		f.ownLimits().MaxWidth = width
+		f.ownLimits().MaxHeight = height
+	}
+}
+
+// WithDecodeLimits replaces all the limits of the downloaded images at once.
+func WithDecodeLimits(limits DecodeLimits) FetcherOption {
+	return func(f *Fetcher) {
+		f.limits = &limits
+	}
+}
+
+// WithDecodeOptions sets the options the downloaded images are decoded with.
+func WithDecodeOptions(opts DecodeOptions) FetcherOption {
+	return func(f *Fetcher) {
+		f.decodeOpts = &opts
+	}
+}
+
+// WithAllowedSchemes sets the URL schemes the Fetcher accepts, including the ones of redirects.
+func WithAllowedSchemes(schemes ...string) FetcherOption {
+	return func(f *Fetcher) {
+		f.allowedSchemes = schemes
+	}
+}
+
+// WithPrivateAddressesBlocked makes the Fetcher refuse to connect to loopback, private, link-local,
+// unspecified and carrier-grade NAT IP addresses, including the ones embedded into NAT64, 6to4 and other
+// IPv6 addresses, which protects internal services from the URLs passed by users.
+// The addresses are checked after the host name is resolved, so it works for redirects and DNS rebinding too.
+//
+// The Fetcher must use an HTTP client with *http.Transport, or no transport at all, to block the addresses.
+func WithPrivateAddressesBlocked() FetcherOption {
+	return func(f *Fetcher) {
+		f.blockPrivateIPs = true
+	}
+}
+
+// NewFetcher returns a Fetcher with the default limits, changed by the options.
+func NewFetcher(opts ...FetcherOption) (*Fetcher, error) {
+	f := &Fetcher{
+		client:         &http.Client{Timeout: defaultFetchTimeout},
+		allowedSchemes: []string{"http", "https"},
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.client == nil {
+		return nil, fmt.Errorf("HTTP client is nil")
+	}
+	// The client is copied, so the caller's one remains intact
+	client := *f.client
+	checkRedirect := client.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !f.schemeAllowed(req.URL.Scheme) {
+			return fmt.Errorf("redirect to URL scheme %q is not allowed", req.URL.Scheme)
+		}
+		if checkRedirect != nil {
+			return checkRedirect(req, via)
+		}
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+	if f.blockPrivateIPs {
+		transport, err := blockingTransport(client.Transport)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = transport
+	}
+	f.client = &client
+	return f, nil
+}
+
+func mustNewFetcher(opts ...FetcherOption) *Fetcher {
+	f, err := NewFetcher(opts...)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// blockingTransport returns a copy of the transport that refuses to connect to private addresses
+func blockingTransport(rt http.RoundTripper) (*http.Transport, error) {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("can't block private addresses with %T, *http.Transport expected", rt)
+	}
+	t = t.Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+			}
+			return nil
+		},
+	}
+	t.DialContext = dialer.DialContext
+	// A proxy would connect to the blocked addresses on the Fetcher's behalf
+	t.Proxy = nil
+	return t, nil
+}
+
+// blockedNets are the networks that lead to internal services, besides the ones net.IP reports as private,
+// loopback, link-local or unspecified
+var blockedNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),      // "this network", connecting to it reaches the host itself
+	mustParseCIDR("100.64.0.0/10"),  // carrier-grade NAT, cloud providers use it for internal networks too
+	mustParseCIDR("64:ff9b:1::/48"), // local-use NAT64
+}
+
+// The IPv6 addresses of these networks embed IPv4 addresses, which are checked as well
+var (
+	nat64Net          = mustParseCIDR("64:ff9b::/96")
+	ipv4CompatibleNet = mustParseCIDR("::/96")
+	sixToFourNet      = mustParseCIDR("2002::/16")
+)
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// isPrivateIP reports whether the address, or the IPv4 address embedded into it, leads to an internal network.
+// IPv4-mapped addresses are treated as the IPv4 ones by net.IP.
+func isPrivateIP(ip net.IP) bool {
+	if v4 := embeddedIPv4(ip); v4 != nil && isPrivateIP(v4) {
+		return true
+	}
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// embeddedIPv4 returns the IPv4 address embedded into the NAT64, IPv4-compatible or 6to4 IPv6 address,
+// or nil if there is none
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return nil
+	}
+	ip = ip.To16()
+	switch {
+	case ip == nil:
+		return nil
+	case nat64Net.Contains(ip), ipv4CompatibleNet.Contains(ip):
+		return ip[12:16]
+	case sixToFourNet.Contains(ip):
+		return ip[2:6]
+	}
+	return nil
+}
+
+func (f *Fetcher) schemeAllowed(scheme string) bool {
+	for _, allowed := range f.allowedSchemes {
+		if strings.EqualFold(scheme, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch downloads the image and decodes it.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (img image.Image, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if !f.schemeAllowed(u.Scheme) {
+		return nil, fmt.Errorf("URL scheme %q is not allowed", u.Scheme)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		closingErr := Body.Close()
+		if err == nil && closingErr != nil {
+			err = closingErr
+			img = nil
+		}
+	}(res.Body)
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("received code %d, 200 expected", res.StatusCode)
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !strings.HasPrefix(mediaType, "image/") {
+			return nil, fmt.Errorf("received Content-Type %q, image expected", contentType)
+		}
+	}
+	limits := f.decodeLimits()
+	if limits.MaxBytes > 0 && res.ContentLength > limits.MaxBytes {
+		return nil, fmt.Errorf("%w: %d bytes", ErrImageTooLarge, res.ContentLength)
+	}
+	opts := DefaultDecodeOptions
+	if f.decodeOpts != nil {
+		opts = *f.decodeOpts
+	}
+	return DecodeImage(res.Body, limits, opts)
+}
+
+// ownLimits returns the limits of the Fetcher for the options to change,
+// which are a copy of DefaultDecodeLimits until an option sets them
+func (f *Fetcher) ownLimits() *DecodeLimits {
+	if f.limits == nil {
+		limits := DefaultDecodeLimits
+		f.limits = &limits
+	}
+	return f.limits
+}
+
+// decodeLimits returns the limits the downloaded images are checked against
+func (f *Fetcher) decodeLimits() DecodeLimits {
+	if f.limits == nil {
+		return DefaultDecodeLimits
+	}
+	return *f.limits
+}
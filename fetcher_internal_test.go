@@ -0,0 +1,42 @@
+package imgidx
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	for addr, private := range map[string]bool{
+		"8.8.8.8":                  false,
+		"10.1.2.3":                 true,
+		"127.0.0.1":                true,
+		"169.254.169.254":          true,
+		"0.0.0.0":                  true,
+		"0.1.2.3":                  true,
+		"100.64.0.1":               true,
+		"100.127.255.254":          true,
+		"100.128.0.1":              false,
+		"::1":                      true,
+		"fd00::1":                  true,
+		"fe80::1":                  true,
+		"2001:4860:4860::8888":     false,
+		"::ffff:10.0.0.1":          true,
+		"::ffff:100.64.0.1":        true,
+		"::ffff:8.8.8.8":           false,
+		"::10.0.0.1":               true,
+		"::127.0.0.1":              true,
+		"64:ff9b::10.0.0.1":        true,
+		"64:ff9b::169.254.169.254": true,
+		"64:ff9b::8.8.8.8":         false,
+		"64:ff9b:1::8.8.8.8":       true,
+		"2002:a00:1::1":            true, // 6to4 of 10.0.0.1
+		"2002:7f00:1::1":           true, // 6to4 of 127.0.0.1
+		"2002:808:808::1":          false,
+	} {
+		ip := net.ParseIP(addr)
+		assert.NotNil(t, ip, addr)
+		assert.Equal(t, private, isPrivateIP(ip), addr)
+	}
+}
@@ -0,0 +1,135 @@
+package imgidx_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/alef-ru/imgidx"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// servePNG runs a server that responds with a blank PNG image of the given size and Content-Type
+func servePNG(t *testing.T, width, height int, contentType string) *httptest.Server {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write(buf.Bytes())
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetcher(t *testing.T) {
+	server := servePNG(t, 200, 100, "image/png")
+	f, err := imgidx.NewFetcher()
+	assert.NoError(t, err)
+	img, err := f.Fetch(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 200, 100), img.Bounds())
+}
+
+func TestFetcherLimits(t *testing.T) {
+	server := servePNG(t, 200, 100, "image/png")
+
+	f, err := imgidx.NewFetcher(imgidx.WithMaxImageSize(100, 100))
+	assert.NoError(t, err)
+	_, err = f.Fetch(context.Background(), server.URL)
+	assert.ErrorIs(t, err, imgidx.ErrImageTooLarge)
+
+	f, err = imgidx.NewFetcher(imgidx.WithMaxDownloadSize(10))
+	assert.NoError(t, err)
+	_, err = f.Fetch(context.Background(), server.URL)
+	assert.ErrorIs(t, err, imgidx.ErrImageTooLarge)
+
+	f, err = imgidx.NewFetcher(imgidx.WithAllowedSchemes("https"))
+	assert.NoError(t, err)
+	_, err = f.Fetch(context.Background(), server.URL)
+	assert.ErrorContains(t, err, `URL scheme "http" is not allowed`)
+
+	html := servePNG(t, 1, 1, "text/html")
+	_, err = imgidx.DefaultFetcher.Fetch(context.Background(), html.URL)
+	assert.ErrorContains(t, err, `received Content-Type "text/html", image expected`)
+}
+
+func TestFetcherDecodeOptions(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	data := jpegWithOrientation(t, img, 6, binary.BigEndian)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+
+	res, err := imgidx.DefaultFetcher.Fetch(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Pt(64, 32), res.Bounds().Size())
+
+	f, err := imgidx.NewFetcher(imgidx.WithDecodeOptions(imgidx.DecodeOptions{AutoOrient: true}))
+	assert.NoError(t, err)
+	res, err = f.Fetch(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Pt(32, 64), res.Bounds().Size())
+}
+
+func TestFetcherDefaultDecodeLimits(t *testing.T) {
+	// The Fetchers without their own limits follow the changes of DefaultDecodeLimits
+	server := servePNG(t, 200, 100, "image/png")
+	own, err := imgidx.NewFetcher(imgidx.WithDecodeLimits(imgidx.DefaultDecodeLimits))
+	assert.NoError(t, err)
+	f, err := imgidx.NewFetcher()
+	assert.NoError(t, err)
+	limits := imgidx.DefaultDecodeLimits
+	t.Cleanup(func() { imgidx.DefaultDecodeLimits = limits })
+	imgidx.DefaultDecodeLimits.MaxPixels = 100
+
+	_, err = f.Fetch(context.Background(), server.URL)
+	assert.ErrorIs(t, err, imgidx.ErrImageTooLarge)
+	_, err = imgidx.DefaultFetcher.Fetch(context.Background(), server.URL)
+	assert.ErrorIs(t, err, imgidx.ErrImageTooLarge)
+	_, err = imgidx.AddImageUrl(newKD3Index(t), server.URL, nil)
+	assert.ErrorIs(t, err, imgidx.ErrImageTooLarge)
+	_, err = own.Fetch(context.Background(), server.URL)
+	assert.NoError(t, err)
+}
+
+func TestFetcherPrivateAddressesBlocked(t *testing.T) {
+	server := servePNG(t, 1, 1, "image/png")
+	f, err := imgidx.NewFetcher(imgidx.WithPrivateAddressesBlocked())
+	assert.NoError(t, err)
+	_, err = f.Fetch(context.Background(), server.URL)
+	assert.ErrorIs(t, err, imgidx.ErrBlockedAddress)
+
+	// Redirects to the private addresses are blocked as well
+	redirect := httptest.NewServer(http.RedirectHandler(server.URL, http.StatusFound))
+	defer redirect.Close()
+	_, err = f.Fetch(context.Background(), redirect.URL)
+	assert.ErrorIs(t, err, imgidx.ErrBlockedAddress)
+}
+
+type countingTransport struct {
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestFetcherHTTPClient(t *testing.T) {
+	server := servePNG(t, 1, 1, "image/png")
+	transport := &countingTransport{}
+	f, err := imgidx.NewFetcher(imgidx.WithHTTPClient(&http.Client{Transport: transport}))
+	assert.NoError(t, err)
+	_, err = f.Fetch(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, transport.requests)
+
+	_, err = imgidx.NewFetcher(imgidx.WithHTTPClient(&http.Client{Transport: transport}),
+		imgidx.WithPrivateAddressesBlocked())
+	assert.ErrorContains(t, err, "can't block private addresses")
+}
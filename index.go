@@ -1,6 +1,9 @@
 package imgidx
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/alef-ru/imgidx/embedders"
 	"gorm.io/gorm"
@@ -9,13 +12,18 @@ import (
 	_ "image/jpeg" // register JPEG decoder
 	_ "image/png"  // register PNG decoder
 	"io"
-	"net/http"
+	"math/bits"
 	"os"
-	"path/filepath"
+	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 )
 import "gonum.org/v1/gonum/spatial/kdtree"
 
+// ErrNotFound is returned if there is no image in the index that meets the search conditions
+var ErrNotFound = errors.New("no matching image found in the index")
+
 // URIAlreadyExists is returned if the image with the same URI is already in the index
 type URIAlreadyExists struct {
 	uri string
@@ -35,6 +43,9 @@ func (target URIAlreadyExists) Is(err error) bool {
 
 // Index is an index of images that be searched for nearest neighbors: most similar images
 // It's not supposed to keep the images in memory, but only some compact representation of the images (the vectors ).
+//
+// The methods that may take long have versions with the Context suffix, which respect cancellation and deadlines.
+// The rest of the methods don't block.
 type Index interface {
 	// AddImage adds the image img to the index and returns its vector representation.
 	//
@@ -48,6 +59,9 @@ type Index interface {
 	// without reindexing all the images.
 	AddImage(img image.Image, uri string, attrs interface{}) (embedders.Vector, error)
 
+	// AddImageContext is the same as AddImage, but it gives up once ctx is done.
+	AddImageContext(ctx context.Context, img image.Image, uri string, attrs interface{}) (embedders.Vector, error)
+
 	// AddVector adds a pre-calculated vector to the index.
 	// This method is supposed to be used when restoring the index from a persistent storage.
 	//
@@ -58,103 +72,785 @@ type Index interface {
 	// Vector length must match the index's number of dimensions
 	AddVector(vec embedders.Vector, uri string, attrs interface{}) error
 
+	// AddVectorContext is the same as AddVector, but it gives up once ctx is done.
+	AddVectorContext(ctx context.Context, vec embedders.Vector, uri string, attrs interface{}) error
+
+	// AddImages is the same as AddImage, but for a batch of images.
+	// The images are embedded in parallel, and the index is updated at once,
+	// which is much faster than adding the images one by one.
+	//
+	// If any of the URIs is already in the index or repeats within the batch, none of the images is added.
+	// The returned vectors are in the same order as the items.
+	AddImages(items []ImageItem) ([]embedders.Vector, error)
+
+	// AddImagesContext is the same as AddImages, but it stops embedding the images once ctx is done.
+	AddImagesContext(ctx context.Context, items []ImageItem) ([]embedders.Vector, error)
+
+	// AddVectors is the same as AddVector, but for a batch of vectors.
+	// Only the URI, Vector and Attributes fields of the embeds are used.
+	//
+	// If any of the URIs is already in the index or repeats within the batch, none of the vectors is added.
+	AddVectors(embeds []ImgEmbed) error
+
+	// AddVectorsContext is the same as AddVectors, but it gives up once ctx is done.
+	AddVectorsContext(ctx context.Context, embeds []ImgEmbed) error
+
 	// Nearest embeds the image img into a vector searches for the nearest neighbor in the index.
 	// It returns the found image's attributes as-is and the distance between the given and found images.
 	// Image will always be found unless the index is empty, regardless on the distances.
+	// If the index is empty, ErrNotFound is returned.
 	// It's up to caller to consider it as "match" or "not found" depending on the distance between images.
 	Nearest(img image.Image) (uri string, attrs interface{}, distance float64, err error)
 
+	// NearestContext is the same as Nearest, but it gives up once ctx is done.
+	NearestContext(ctx context.Context, img image.Image) (uri string, attrs interface{}, distance float64, err error)
+
+	// NearestK embeds the image img into a vector and searches for the k nearest neighbors in the index.
+	// The results are ordered by distance, the nearest image goes first.
+	// If the index contains less than k images, all of them are returned.
+	NearestK(img image.Image, k int) ([]SearchResult, error)
+
+	// NearestKContext is the same as NearestK, but it gives up once ctx is done.
+	NearestKContext(ctx context.Context, img image.Image, k int) ([]SearchResult, error)
+
+	// WithinDistance embeds the image img into a vector and searches for all the images in the index
+	// the distance to which doesn't exceed maxDist. The distance is the same as returned by Nearest.
+	// The results are ordered by distance, the nearest image goes first.
+	WithinDistance(img image.Image, maxDist float64) ([]SearchResult, error)
+
+	// WithinDistanceContext is the same as WithinDistance, but it gives up once ctx is done.
+	WithinDistanceContext(ctx context.Context, img image.Image, maxDist float64) ([]SearchResult, error)
+
+	// NearestMatching is the same as Nearest, but it only considers the images the passed function returns true for.
+	// The function has the same signature as the one passed to Remove, so it can filter images by their attributes,
+	// e.g. to keep the search within a single tenant or category.
+	// If none of the images matches, ErrNotFound is returned.
+	NearestMatching(img image.Image, f func(vec embedders.Vector, uri string, attrs interface{}) bool) (
+		uri string, attrs interface{}, distance float64, err error)
+
+	// NearestMatchingContext is the same as NearestMatching, but it gives up once ctx is done.
+	NearestMatchingContext(ctx context.Context, img image.Image,
+		f func(vec embedders.Vector, uri string, attrs interface{}) bool) (
+		uri string, attrs interface{}, distance float64, err error)
+
 	// Remove checks each image representation with the passed function,
 	// and removes the image if the function returns true.
 	//
 	// Remove returns URIs of removed of images.
 	//
-	// This function is implemented this way, not like Remove(id) for two reasons:
-	// - Images in the index have no unique identifier. It's possible to have one in Attributes, but the index doesn't work with it.
-	// - The underlining kdtree implementation doesn't support removal, so we have to rebuild the index, and it's better to do it in one go.
+	// To remove images by their URIs, use RemoveURI, it doesn't check every image in the index.
 	Remove(func(vec embedders.Vector, uri string, attrs interface{}) bool) (removed []string, err error)
 
+	// RemoveContext is the same as Remove, but it stops checking the images once ctx is done.
+	// In that case nothing is removed.
+	RemoveContext(ctx context.Context, f func(vec embedders.Vector, uri string, attrs interface{}) bool) (
+		removed []string, err error)
+
+	// RemoveURI removes the images with the given URIs from the index.
+	// URIs that are not in the index are ignored.
+	//
+	// RemoveURI returns URIs of removed of images.
+	RemoveURI(uris ...string) (removed []string, err error)
+
+	// RemoveURIContext is the same as RemoveURI, but it gives up once ctx is done.
+	RemoveURIContext(ctx context.Context, uris ...string) (removed []string, err error)
+
+	// Get returns the vector and the attributes of the image with the given URI.
+	// ok is false if there is no such image in the index.
+	Get(uri string) (vec embedders.Vector, attrs interface{}, ok bool)
+
+	// Contains reports whether the image with the given URI is in the index.
+	Contains(uri string) bool
+
+	// UpdateAttributes replaces the attributes of the image with the given URI, the vector remains the same.
+	// If there is no such image in the index, ErrNotFound is returned.
+	UpdateAttributes(uri string, attrs interface{}) error
+
+	// UpdateAttributesContext is the same as UpdateAttributes, but it gives up once ctx is done.
+	UpdateAttributesContext(ctx context.Context, uri string, attrs interface{}) error
+
+	// UpsertImage is the same as AddImage, but if the image with the URI is already in the index,
+	// its vector and attributes are replaced instead of causing an error.
+	UpsertImage(img image.Image, uri string, attrs interface{}) (embedders.Vector, error)
+
+	// UpsertImageContext is the same as UpsertImage, but it gives up once ctx is done.
+	UpsertImageContext(ctx context.Context, img image.Image, uri string, attrs interface{}) (embedders.Vector, error)
+
+	// UpsertVector is the same as AddVector, but if the image with the URI is already in the index,
+	// its vector and attributes are replaced instead of causing an error.
+	UpsertVector(vec embedders.Vector, uri string, attrs interface{}) error
+
+	// UpsertVectorContext is the same as UpsertVector, but it gives up once ctx is done.
+	UpsertVectorContext(ctx context.Context, vec embedders.Vector, uri string, attrs interface{}) error
+
 	// GetCount returns the number of images in the index.
 	GetCount() int
+
+	// Rebalance rebuilds the index's internal structure from scratch, which makes the searches faster
+	// if many images were added or removed one by one. Normally, it's done automatically.
+	Rebalance()
+
+	// Stats returns statistics of the index's internal structure.
+	Stats() IndexStats
+}
+
+// IndexStats describes the state of the index's kd-tree
+type IndexStats struct {
+	// Count is the number of images in the index, the same as returned by Index.GetCount.
+	Count int
+	// Nodes is the number of nodes in the kd-tree. It includes removed images that are not compacted yet.
+	Nodes int
+	// Depth is the number of nodes on the longest path from the root of the kd-tree to a leaf.
+	Depth int
+}
+
+// ImageItem is an image to be added to the index by Index.AddImages
+type ImageItem struct {
+	Image      image.Image
+	URI        string
+	Attributes interface{}
+}
+
+// SearchResult is an image found by the searches that return several images, such as Index.NearestK.
+type SearchResult struct {
+	URI        string
+	Attributes interface{}
+	// Distance is the distance between the given and found images, the same as returned by Index.Nearest.
+	Distance float64
+}
+
+const (
+	// defaultCompactionThreshold is the default fraction of removed images in the tree that triggers its compaction
+	defaultCompactionThreshold = 0.25
+	// defaultRebalanceFactor is the default ratio of the tree depth to the depth of a balanced tree
+	// that triggers rebalancing
+	defaultRebalanceFactor = 3
+	// batchRebuildFraction is the size of a batch relative to the size of the tree, from which the tree is built
+	// from scratch rather than the batch is inserted into it
+	batchRebuildFraction = 0.5
+)
+
+// KDTreeOption is an option of the index created by NewKDTreeImageIndex
+type KDTreeOption func(*kDTreeIndex)
+
+// WithCompactionThreshold sets the fraction of removed images in the kd-tree, after which the tree is compacted.
+//
+// The underlining kdtree implementation doesn't support removal, so removed images stay in the tree as tombstones
+// that searches skip over. Once there are too many of them, the tree is rebuilt in the background.
+// Threshold of 0 makes the index rebuild the tree on every removal.
+func WithCompactionThreshold(fraction float64) KDTreeOption {
+	return func(idx *kDTreeIndex) {
+		idx.compactionThreshold = fraction
+	}
+}
+
+// WithRebalanceFactor sets how unbalanced the kd-tree may get before it's rebalanced.
+//
+// Images added one by one are inserted into the tree without rebalancing, so it may degenerate, which slows searches down.
+// Once the tree depth exceeds factor times the depth of a balanced tree of the same size,
+// the tree is rebuilt in the background. Factor of 0 disables automatic rebalancing.
+func WithRebalanceFactor(factor float64) KDTreeOption {
+	return func(idx *kDTreeIndex) {
+		idx.rebalanceFactor = factor
+	}
 }
 
 type kDTreeIndex struct {
-	tree     *kdtree.Tree
 	embedder embedders.ImageEmbedder
 	dims     int
-	lock     sync.RWMutex
-	uris     map[string]bool
+	// snap is the current state of the index. Readers use it without locking,
+	// writers build the next snapshot off to the side and swap it atomically.
+	snap atomic.Pointer[snapshot]
+	// lock serialises writers, the fields below are protected by it
+	lock sync.Mutex
+	// seq is the sequence number of the last image added to the tree
+	seq uint64
+	// builds is the number of times the tree was rebuilt, it tells the background rebuild that it's outdated
+	builds              int
+	compactionThreshold float64
+	rebalanceFactor     float64
+	rebuilding          bool
+}
+
+// snapshot is an immutable state of kDTreeIndex
+type snapshot struct {
+	tree *kdtree.Tree
+	// byURI contains the images that are in the index. An image in the tree is a tombstone
+	// unless it has the same seq as the image with its URI in byURI.
+	// byURI is also the source of truth for the images' attributes, the ones stored in the tree may be outdated.
+	byURI *uriMap
+	// depth is the depth of the tree
+	depth int
+}
+
+// newSnapshot returns a snapshot with a balanced tree of the live images. The order of live is altered.
+func newSnapshot(live embeds) *snapshot {
+	byURI := newURIMap(live)
+	tree := kdtree.New(live, false)
+	return &snapshot{tree: tree, byURI: byURI, depth: treeDepth(tree.Root)}
 }
 
+// deleted returns the number of tombstones in the tree
+func (s *snapshot) deleted() int { return s.tree.Count - s.byURI.len() }
+
 func (idx *kDTreeIndex) AddVector(vec embedders.Vector, uri string, attrs interface{}) error {
+	return idx.AddVectorContext(context.Background(), vec, uri, attrs)
+}
+
+func (idx *kDTreeIndex) AddVectorContext(ctx context.Context, vec embedders.Vector, uri string, attrs interface{}) error {
 	if len(vec) != idx.dims {
 		return fmt.Errorf("vector has %d dimensions. Expected %d", len(vec), idx.dims)
 	}
 	idx.lock.Lock()
 	defer idx.lock.Unlock()
-	if idx.uris[uri] {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cur := idx.snap.Load()
+	if _, ok := cur.byURI.get(uri); ok {
 		return URIAlreadyExists{uri: uri}
 	}
-	idx.tree.Insert(ImgEmbed{URI: uri, Vector: kdtree.Point(vec), Attributes: attrs}, false)
-	idx.uris[uri] = true
+	idx.publish(idx.insert(cur, ImgEmbed{URI: uri, Vector: kdtree.Point(vec), Attributes: attrs}))
+	return nil
+}
+
+// insert returns a copy of the snapshot with the image added. The caller must hold the lock.
+func (idx *kDTreeIndex) insert(s *snapshot, embd ImgEmbed) *snapshot {
+	idx.seq++
+	embd.seq = idx.seq
+	tree, depth := insertIntoTree(s.tree, embd)
+	if depth < s.depth {
+		depth = s.depth
+	}
+	return &snapshot{tree: tree, byURI: s.byURI.with(map[string]*ImgEmbed{embd.URI: &embd}), depth: depth}
+}
+
+// publish makes the snapshot current and rebuilds the tree if needed. The caller must hold the lock.
+func (idx *kDTreeIndex) publish(s *snapshot) {
+	idx.snap.Store(s)
+	idx.maybeRebuild()
+}
+
+// insertIntoTree returns a copy of the tree with c added the same way kdtree.Tree.Insert does,
+// and the depth of the new node. Only the nodes on the path to the new one are copied,
+// the rest of them are shared with the original tree, which remains intact.
+func insertIntoTree(t *kdtree.Tree, c kdtree.Comparable) (*kdtree.Tree, int) {
+	res := &kdtree.Tree{Count: t.Count + 1}
+	depth := 1
+	link := &res.Root
+	plane := kdtree.Dim(0)
+	for n := t.Root; n != nil; depth++ {
+		cp := *n
+		*link = &cp
+		plane = (n.Plane + 1) % kdtree.Dim(c.Dims())
+		if c.Compare(n.Point, n.Plane) <= 0 {
+			link, n = &cp.Left, n.Left
+		} else {
+			link, n = &cp.Right, n.Right
+		}
+	}
+	*link = &kdtree.Node{Point: c, Plane: plane}
+	return res, depth
+}
+
+// treeDepth returns the depth of the subtree
+func treeDepth(n *kdtree.Node) int {
+	if n == nil {
+		return 0
+	}
+	left, right := treeDepth(n.Left), treeDepth(n.Right)
+	if left > right {
+		return left + 1
+	}
+	return right + 1
+}
+
+func (idx *kDTreeIndex) AddVectors(batch []ImgEmbed) error {
+	return idx.AddVectorsContext(context.Background(), batch)
+}
+
+func (idx *kDTreeIndex) AddVectorsContext(ctx context.Context, batch []ImgEmbed) error {
+	for _, embd := range batch {
+		if len(embd.Vector) != idx.dims {
+			return fmt.Errorf("vector of %s has %d dimensions. Expected %d", embd.URI, len(embd.Vector), idx.dims)
+		}
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cur := idx.snap.Load()
+	uris := make(map[string]bool, len(batch))
+	for _, embd := range batch {
+		if _, ok := cur.byURI.get(embd.URI); ok || uris[embd.URI] {
+			return URIAlreadyExists{uri: embd.URI}
+		}
+		uris[embd.URI] = true
+	}
+	if float64(len(batch)) < batchRebuildFraction*float64(cur.tree.Count) {
+		// Rebuilding a large tree for a small batch costs more than inserting the batch into it,
+		// maybeRebuild rebalances the tree once it gets too deep
+		tree, depth := cur.tree, cur.depth
+		added := make(map[string]*ImgEmbed, len(batch))
+		for _, embd := range batch {
+			idx.seq++
+			embd := ImgEmbed{URI: embd.URI, Vector: embd.Vector, Attributes: embd.Attributes, seq: idx.seq}
+			var d int
+			if tree, d = insertIntoTree(tree, embd); d > depth {
+				depth = d
+			}
+			added[embd.URI] = &embd
+		}
+		idx.publish(&snapshot{tree: tree, byURI: cur.byURI.with(added), depth: depth})
+		return nil
+	}
+	live := cur.byURI.values()
+	for _, embd := range batch {
+		idx.seq++
+		live = append(live, ImgEmbed{URI: embd.URI, Vector: embd.Vector, Attributes: embd.Attributes, seq: idx.seq})
+	}
+	// Inserting a large batch one by one would leave the tree unbalanced, so it's built from scratch
+	idx.rebuild(live)
 	return nil
 }
 
+func (idx *kDTreeIndex) AddImages(items []ImageItem) ([]embedders.Vector, error) {
+	return idx.AddImagesContext(context.Background(), items)
+}
+
+func (idx *kDTreeIndex) AddImagesContext(ctx context.Context, items []ImageItem) ([]embedders.Vector, error) {
+	vecs, err := idx.embedAll(ctx, items)
+	if err != nil {
+		return nil, err
+	}
+	batch := make([]ImgEmbed, len(items))
+	for i, item := range items {
+		batch[i] = ImgEmbed{URI: item.URI, Vector: kdtree.Point(vecs[i]), Attributes: item.Attributes}
+	}
+	if err := idx.AddVectorsContext(ctx, batch); err != nil {
+		return nil, err
+	}
+	return vecs, nil
+}
+
+// embed embeds the image into a vector, unless ctx is already done
+func (idx *kDTreeIndex) embed(ctx context.Context, img image.Image) (embedders.Vector, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return embedders.Embed(idx.embedder, img)
+}
+
+// embedAll embeds the images in parallel, using a worker per CPU.
+// It returns the vectors in the same order as the items.
+// Once ctx is done, the images that are not embedded yet are skipped and ctx.Err() is returned.
+func (idx *kDTreeIndex) embedAll(ctx context.Context, items []ImageItem) ([]embedders.Vector, error) {
+	vecs := make([]embedders.Vector, len(items))
+	errs := make([]error, len(items))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				vecs[i], errs[i] = embedders.Embed(idx.embedder, items[i].Image)
+			}
+		}()
+	}
+feed:
+	for i := range items {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed image %s: %w", items[i].URI, err)
+		}
+	}
+	return vecs, nil
+}
+
 func (idx *kDTreeIndex) Nearest(img image.Image) (uri string, attrs interface{}, distance float64, err error) {
-	vec, err := idx.embedder.Img2Vec(embedders.ImageToRGBA(img))
+	return idx.NearestContext(context.Background(), img)
+}
+
+func (idx *kDTreeIndex) NearestContext(ctx context.Context, img image.Image) (
+	uri string, attrs interface{}, distance float64, err error) {
+	return idx.NearestMatchingContext(ctx, img, nil)
+}
+
+func (idx *kDTreeIndex) NearestK(img image.Image, k int) ([]SearchResult, error) {
+	return idx.NearestKContext(context.Background(), img, k)
+}
+
+func (idx *kDTreeIndex) NearestKContext(ctx context.Context, img image.Image, k int) ([]SearchResult, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("k must be greater than 0, got %d", k)
+	}
+	found, err := idx.search(ctx, img, func() kdtree.Keeper { return kdtree.NewNKeeper(k) }, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) > k {
+		found = found[:k]
+	}
+	return found, nil
+}
+
+func (idx *kDTreeIndex) WithinDistance(img image.Image, maxDist float64) ([]SearchResult, error) {
+	return idx.WithinDistanceContext(context.Background(), img, maxDist)
+}
+
+func (idx *kDTreeIndex) WithinDistanceContext(ctx context.Context, img image.Image, maxDist float64) (
+	[]SearchResult, error) {
+	if maxDist < 0 {
+		return nil, fmt.Errorf("maxDist must not be negative, got %v", maxDist)
+	}
+	return idx.search(ctx, img, func() kdtree.Keeper { return kdtree.NewDistKeeper(maxDist) }, nil)
+}
+
+func (idx *kDTreeIndex) NearestMatching(img image.Image, f func(embedders.Vector, string, interface{}) bool) (
+	string, interface{}, float64, error) {
+	return idx.NearestMatchingContext(context.Background(), img, f)
+}
+
+func (idx *kDTreeIndex) NearestMatchingContext(ctx context.Context, img image.Image,
+	f func(embedders.Vector, string, interface{}) bool) (string, interface{}, float64, error) {
+	found, err := idx.search(ctx, img, func() kdtree.Keeper { return kdtree.NewNKeeper(1) }, f)
 	if err != nil {
 		return "", nil, 0, err
 	}
-	idx.lock.RLock()
-	defer idx.lock.RUnlock()
-	got, dist := idx.tree.Nearest(ImgEmbed{Vector: kdtree.Point(vec)})
-	embd, ok := got.(ImgEmbed)
+	if len(found) == 0 {
+		return "", nil, 0, ErrNotFound
+	}
+	return found[0].URI, found[0].Attributes, found[0].Distance, nil
+}
+
+// search embeds the image and searches the index for the images accepted by the keepers newKeeper returns
+// and the filter. If the embedder is an embedders.VariantEmbedder, the index is searched with each of the variants,
+// and an image found by several of them is returned once, at the smallest of the distances.
+// The results are ordered by distance.
+func (idx *kDTreeIndex) search(ctx context.Context, img image.Image, newKeeper func() kdtree.Keeper,
+	filter func(embedders.Vector, string, interface{}) bool) ([]SearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	vecs, err := embedders.EmbedVariants(idx.embedder, img)
+	if err != nil {
+		return nil, err
+	}
+	s := idx.snap.Load()
+	if len(vecs) == 1 {
+		return s.nearestSet(ctx, vecs[0], newKeeper(), filter)
+	}
+	var results []SearchResult
+	byURI := map[string]int{}
+	for _, vec := range vecs {
+		found, err := s.nearestSet(ctx, vec, newKeeper(), filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range found {
+			i, ok := byURI[r.URI]
+			if !ok {
+				byURI[r.URI] = len(results)
+				results = append(results, r)
+			} else if r.Distance < results[i].Distance {
+				results[i].Distance = r.Distance
+			}
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Distance < results[j].Distance })
+	return results, nil
+}
+
+// liveKeeper is a kdtree.Keeper that ignores tombstones and the images rejected by the filter, if it's set.
+// The kd-tree search is pruned by the distance of the kept images only,
+// so the traversal goes on until it finds the nearest images the keeper accepts.
+type liveKeeper struct {
+	kdtree.Keeper
+	byURI  *uriMap
+	filter func(vec embedders.Vector, uri string, attrs interface{}) bool
+}
+
+func (k liveKeeper) Keep(c kdtree.ComparableDist) {
+	embd, ok := c.Comparable.(ImgEmbed)
 	if !ok {
-		return "", nil, 0, fmt.Errorf("got %T, expected ImgEmbed", got)
+		return
+	}
+	live, ok := k.byURI.get(embd.URI)
+	if !ok || live.seq != embd.seq {
+		return
+	}
+	if k.filter == nil || k.filter(embedders.Vector(live.Vector), live.URI, live.Attributes) {
+		k.Keeper.Keep(c)
 	}
-	return embd.URI, embd.Attributes, dist, nil
+}
+
+// nearestSet searches the tree for the images accepted by the keeper and the filter, skipping tombstones.
+// It returns the found images ordered by distance.
+// The traversal of the tree can't be interrupted, so ctx is only checked before it.
+func (s *snapshot) nearestSet(ctx context.Context, vec embedders.Vector, keeper kdtree.Keeper,
+	filter func(embedders.Vector, string, interface{}) bool) ([]SearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.tree.NearestSet(liveKeeper{Keeper: keeper, byURI: s.byURI, filter: filter}, ImgEmbed{Vector: kdtree.Point(vec)})
+	// NearestSet leaves the keeper sorted by distance, so popping yields the farthest image first
+	results := make([]SearchResult, keeper.Len())
+	n := len(results)
+	for keeper.Len() > 0 {
+		cd := keeper.Pop().(kdtree.ComparableDist)
+		if cd.Comparable == nil { // the sentinel is left in the keeper if the tree is empty
+			continue
+		}
+		embd, ok := cd.Comparable.(ImgEmbed)
+		if !ok {
+			return nil, fmt.Errorf("got %T, expected ImgEmbed", cd.Comparable)
+		}
+		live, _ := s.byURI.get(embd.URI)
+		n--
+		results[n] = SearchResult{URI: embd.URI, Attributes: live.Attributes, Distance: cd.Dist}
+	}
+	return results[n:], nil
 }
 
 func (idx *kDTreeIndex) Remove(f func(vec embedders.Vector, uri string, attrs interface{}) bool) ([]string, error) {
-	//FixMe: it seems inefficient to rebuild the index every time, but it's the easiest way to implement Remove
-	keep := make(embeds, 0)
+	return idx.RemoveContext(context.Background(), f)
+}
+
+// ctxCheckInterval is how many images a loop over the whole index processes between checks of the context
+const ctxCheckInterval = 1024
+
+func (idx *kDTreeIndex) RemoveContext(ctx context.Context,
+	f func(vec embedders.Vector, uri string, attrs interface{}) bool) ([]string, error) {
 	var remove []string
-	var err error
 	idx.lock.Lock()
 	defer idx.lock.Unlock()
-	idx.tree.Do(func(c kdtree.Comparable, _ *kdtree.Bounding, _ int) bool {
-		embd, ok := c.(ImgEmbed)
-		if !ok {
-			err = fmt.Errorf("KDTree contained %T, expected ImgEmbed only", c)
-			return true
+	cur := idx.snap.Load()
+	var err error
+	i := 0
+	cur.byURI.each(func(embd ImgEmbed) bool {
+		i++
+		if i%ctxCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return false
+			}
 		}
 		if f(embedders.Vector(embd.Vector), embd.URI, embd.Attributes) {
 			remove = append(remove, embd.URI)
-		} else {
-			keep = append(keep, embd)
 		}
-		return false
+		return true
 	})
+	if err == nil {
+		err = ctx.Err()
+	}
 	if err != nil {
 		return nil, err
 	}
-	if len(remove) != 0 {
-		idx.tree = kdtree.New(keep, false)
-		idx.uris = make(map[string]bool, len(keep))
-		for _, embd := range keep {
-			idx.uris[embd.URI] = true
+	idx.remove(cur, remove)
+	return remove, nil
+}
+
+func (idx *kDTreeIndex) RemoveURI(uris ...string) ([]string, error) {
+	return idx.RemoveURIContext(context.Background(), uris...)
+}
+
+func (idx *kDTreeIndex) RemoveURIContext(ctx context.Context, uris ...string) ([]string, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cur := idx.snap.Load()
+	var removed []string
+	for _, uri := range uris {
+		if _, ok := cur.byURI.get(uri); ok {
+			removed = append(removed, uri)
 		}
 	}
-	return remove, nil
+	idx.remove(cur, removed)
+	return removed, nil
+}
+
+// remove publishes a copy of the snapshot, where the images with the URIs are tombstones.
+// The caller must hold the lock.
+func (idx *kDTreeIndex) remove(s *snapshot, uris []string) {
+	if len(uris) == 0 {
+		return
+	}
+	changes := make(map[string]*ImgEmbed, len(uris))
+	for _, uri := range uris {
+		changes[uri] = nil
+	}
+	idx.publish(&snapshot{tree: s.tree, byURI: s.byURI.with(changes), depth: s.depth})
+}
+
+// maybeRebuild rebuilds the tree if the fraction of tombstones in it exceeds the compaction threshold,
+// or if it's too unbalanced. Unless the compaction threshold is 0, the new tree is built in the background.
+// The caller must hold the lock.
+func (idx *kDTreeIndex) maybeRebuild() {
+	cur := idx.snap.Load()
+	deleted := cur.deleted()
+	tooSparse := deleted > 0 && float64(deleted) > idx.compactionThreshold*float64(cur.tree.Count)
+	tooDeep := idx.rebalanceFactor > 0 &&
+		float64(cur.depth) > idx.rebalanceFactor*float64(bits.Len(uint(cur.tree.Count)))
+	switch {
+	case !tooSparse && !tooDeep:
+		return
+	case tooSparse && idx.compactionThreshold <= 0:
+		idx.rebuild(cur.byURI.values())
+	case !idx.rebuilding:
+		idx.rebuilding = true
+		go idx.rebuildInBackground(cur.byURI.values(), idx.seq, idx.builds)
+	}
+}
+
+// rebuildInBackground builds a new tree of the live images without holding the lock,
+// and then replaces the old tree with it.
+// seq is the sequence number of the last image added before live was taken, builds is the value of idx.builds then.
+func (idx *kDTreeIndex) rebuildInBackground(live embeds, seq uint64, builds int) {
+	tree := kdtree.New(live, false)
+	depth := treeDepth(tree.Root)
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.rebuilding = false
+	if idx.builds != builds { // The tree was rebuilt in the meantime, so this one is outdated
+		return
+	}
+	// The images removed in the meantime remain in the new tree as tombstones, the added ones are inserted into it
+	cur := idx.snap.Load()
+	cur.byURI.each(func(embd ImgEmbed) bool {
+		if embd.seq > seq {
+			var d int
+			if tree, d = insertIntoTree(tree, embd); d > depth {
+				depth = d
+			}
+		}
+		return true
+	})
+	idx.snap.Store(&snapshot{tree: tree, byURI: cur.byURI, depth: depth})
+	idx.builds++
+}
+
+// rebuild makes a snapshot with a new tree built of the live images current. The caller must hold the lock.
+func (idx *kDTreeIndex) rebuild(live embeds) {
+	idx.snap.Store(newSnapshot(live))
+	idx.builds++
+}
+
+func (idx *kDTreeIndex) Rebalance() {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.rebuild(idx.snap.Load().byURI.values())
+}
+
+func (idx *kDTreeIndex) Stats() IndexStats {
+	cur := idx.snap.Load()
+	return IndexStats{Count: cur.byURI.len(), Nodes: cur.tree.Count, Depth: cur.depth}
+}
+
+func (idx *kDTreeIndex) UpdateAttributes(uri string, attrs interface{}) error {
+	return idx.UpdateAttributesContext(context.Background(), uri, attrs)
+}
+
+func (idx *kDTreeIndex) UpdateAttributesContext(ctx context.Context, uri string, attrs interface{}) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cur := idx.snap.Load()
+	embd, ok := cur.byURI.get(uri)
+	if !ok {
+		return fmt.Errorf("failed to update attributes of %s: %w", uri, ErrNotFound)
+	}
+	embd.Attributes = attrs
+	idx.snap.Store(&snapshot{tree: cur.tree, byURI: cur.byURI.with(map[string]*ImgEmbed{uri: &embd}), depth: cur.depth})
+	return nil
+}
+
+func (idx *kDTreeIndex) UpsertVector(vec embedders.Vector, uri string, attrs interface{}) error {
+	return idx.UpsertVectorContext(context.Background(), vec, uri, attrs)
+}
+
+func (idx *kDTreeIndex) UpsertVectorContext(ctx context.Context, vec embedders.Vector, uri string,
+	attrs interface{}) error {
+	if len(vec) != idx.dims {
+		return fmt.Errorf("vector has %d dimensions. Expected %d", len(vec), idx.dims)
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cur := idx.snap.Load()
+	embd := ImgEmbed{URI: uri, Vector: kdtree.Point(vec), Attributes: attrs}
+	if old, ok := cur.byURI.get(uri); ok && old.Vector.Distance(embd.Vector) == 0 {
+		embd.seq = old.seq
+		idx.snap.Store(&snapshot{tree: cur.tree, byURI: cur.byURI.with(map[string]*ImgEmbed{uri: &embd}), depth: cur.depth})
+		return nil
+	}
+	// If the image is already in the index, its old vector becomes a tombstone
+	idx.publish(idx.insert(cur, embd))
+	return nil
+}
+
+func (idx *kDTreeIndex) UpsertImage(img image.Image, uri string, attrs interface{}) (embedders.Vector, error) {
+	return idx.UpsertImageContext(context.Background(), img, uri, attrs)
+}
+
+func (idx *kDTreeIndex) UpsertImageContext(ctx context.Context, img image.Image, uri string, attrs interface{}) (
+	embedders.Vector, error) {
+	vec, err := idx.embed(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	err = idx.UpsertVectorContext(ctx, vec, uri, attrs)
+	if err != nil {
+		return nil, err
+	}
+	return vec, nil
+}
+
+func (idx *kDTreeIndex) Get(uri string) (embedders.Vector, interface{}, bool) {
+	embd, ok := idx.snap.Load().byURI.get(uri)
+	if !ok {
+		return nil, nil, false
+	}
+	// the vector is copied, so the caller can't corrupt the tree by modifying it
+	vec := make(embedders.Vector, len(embd.Vector))
+	copy(vec, embd.Vector)
+	return vec, embd.Attributes, true
+}
+
+func (idx *kDTreeIndex) Contains(uri string) bool {
+	_, ok := idx.snap.Load().byURI.get(uri)
+	return ok
 }
 
 func (idx *kDTreeIndex) AddImage(img image.Image, uri string, attrs interface{}) (embedders.Vector, error) {
+	return idx.AddImageContext(context.Background(), img, uri, attrs)
+}
+
+func (idx *kDTreeIndex) AddImageContext(ctx context.Context, img image.Image, uri string, attrs interface{}) (
+	embedders.Vector, error) {
 	//log.Println("Adding image", URI)
-	vec, err := idx.embedder.Img2Vec(embedders.ImageToRGBA(img))
+	vec, err := idx.embed(ctx, img)
 	if err != nil {
 		return nil, err
 	}
-	err = idx.AddVector(vec, uri, attrs)
+	err = idx.AddVectorContext(ctx, vec, uri, attrs)
 	if err != nil {
 		return nil, err
 	}
@@ -162,12 +858,11 @@ func (idx *kDTreeIndex) AddImage(img image.Image, uri string, attrs interface{})
 }
 
 func (idx *kDTreeIndex) GetCount() int {
-	idx.lock.RLock()
-	defer idx.lock.RUnlock()
-	return idx.tree.Count
+	return idx.snap.Load().byURI.len()
 }
 
-func NewKDTreeImageIndex(embedder embedders.ImageEmbedder) (Index, error) {
+// NewKDTreeImageIndex returns an in-memory index that keeps vectors produced by the embedder in a kd-tree.
+func NewKDTreeImageIndex(embedder embedders.ImageEmbedder, opts ...KDTreeOption) (Index, error) {
 	var index kDTreeIndex
 	if embedder == nil {
 		return nil, fmt.Errorf("embedder is nil")
@@ -177,22 +872,29 @@ func NewKDTreeImageIndex(embedder embedders.ImageEmbedder) (Index, error) {
 		return nil, fmt.Errorf("embedder has %d dimensions. A positive number expected", index.dims)
 	}
 	index.embedder = embedder
-	index.tree = kdtree.New(make(embeds, 0), false)
-	index.uris = make(map[string]bool)
+	index.snap.Store(newSnapshot(nil))
+	index.compactionThreshold = defaultCompactionThreshold
+	index.rebalanceFactor = defaultRebalanceFactor
+	for _, opt := range opts {
+		opt(&index)
+	}
 	return &index, nil
 }
 
 func AddImageFile(idx Index, path string, attrs interface{}) (embedders.Vector, error) {
+	return AddImageFileContext(context.Background(), idx, path, attrs)
+}
+
+func AddImageFileContext(ctx context.Context, idx Index, path string, attrs interface{}) (embedders.Vector, error) {
 	img, err := readImageFile(path)
 	if err != nil {
 		return nil, err
 	}
-	wd, err := os.Getwd()
+	uri, err := fileURI(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get current working directory: %w", err)
+		return nil, err
 	}
-	uri := "file://" + filepath.Join(wd, path)
-	return idx.AddImage(img, uri, attrs)
+	return idx.AddImageContext(ctx, img, uri, attrs)
 }
 
 func readImageFile(path string) (img image.Image, err error) {
@@ -208,56 +910,118 @@ func readImageFile(path string) (img image.Image, err error) {
 		}
 	}()
 
-	img, _, err = image.Decode(f)
+	return DecodeImage(f, DefaultDecodeLimits, DefaultDecodeOptions)
+}
+
+func AddImageUrl(idx Index, url string, attrs interface{}) (embedders.Vector, error) {
+	return AddImageUrlContext(context.Background(), idx, url, attrs)
+}
+
+func AddImageUrlContext(ctx context.Context, idx Index, url string, attrs interface{}) (embedders.Vector, error) {
+	img, err := DefaultFetcher.Fetch(ctx, url)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to get %v, %w", url, err)
 	}
-	return img, nil
+	return idx.AddImageContext(ctx, img, url, attrs)
+}
+
+func NearestByURL(idx Index, url string) (uri string, attrs interface{}, distance float64, err error) {
+	return NearestByURLContext(context.Background(), idx, url)
 }
 
-func downloadImage(url string) (image.Image, error) {
-	res, err := http.Get(url)
+func NearestByURLContext(ctx context.Context, idx Index, url string) (
+	uri string, attrs interface{}, distance float64, err error) {
+	img, err := DefaultFetcher.Fetch(ctx, url)
 	if err != nil {
-		return nil, err
-	}
-	defer func(Body io.ReadCloser) {
-		closingErr := Body.Close()
-		if err != nil {
-			err = closingErr
-		}
-	}(res.Body)
-	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("received code %d, 200 expected", res.StatusCode)
+		return "", nil, -1, fmt.Errorf("failed to get %v, %w", url, err)
 	}
-	img, _, err := image.Decode(res.Body)
+	return idx.NearestContext(ctx, img)
+}
+
+func NearestByFile(idx Index, path string) (uri string, attrs interface{}, distance float64, err error) {
+	return NearestByFileContext(context.Background(), idx, path)
+}
+
+func NearestByFileContext(ctx context.Context, idx Index, path string) (
+	uri string, attrs interface{}, distance float64, err error) {
+	img, err := readImageFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode image: %w", err)
+		return "", nil, -1, fmt.Errorf("failed to read %v, %w", path, err)
 	}
-	return img, nil
+	return idx.NearestContext(ctx, img)
 }
 
-func AddImageUrl(idx Index, url string, attrs interface{}) (embedders.Vector, error) {
-	img, err := downloadImage(url)
+func WithinDistanceByURL(idx Index, url string, maxDist float64) ([]SearchResult, error) {
+	return WithinDistanceByURLContext(context.Background(), idx, url, maxDist)
+}
+
+func WithinDistanceByURLContext(ctx context.Context, idx Index, url string, maxDist float64) ([]SearchResult, error) {
+	img, err := DefaultFetcher.Fetch(ctx, url)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get %v, %w", url, err)
 	}
-	return idx.AddImage(img, url, attrs)
+	return idx.WithinDistanceContext(ctx, img, maxDist)
 }
 
-func NearestByURL(idx Index, url string) (uri string, attrs interface{}, distance float64, err error) {
-	img, err := downloadImage(url)
+func WithinDistanceByFile(idx Index, path string, maxDist float64) ([]SearchResult, error) {
+	return WithinDistanceByFileContext(context.Background(), idx, path, maxDist)
+}
+
+func WithinDistanceByFileContext(ctx context.Context, idx Index, path string, maxDist float64) (
+	[]SearchResult, error) {
+	img, err := readImageFile(path)
 	if err != nil {
-		return "", nil, -1, fmt.Errorf("failed to get %v, %w", url, err)
+		return nil, fmt.Errorf("failed to read %v, %w", path, err)
 	}
-	return idx.Nearest(img)
+	return idx.WithinDistanceContext(ctx, img, maxDist)
 }
 
-func NearestByFile(idx Index, path string) (uri string, attrs interface{}, distance float64, err error) {
-	img, err := readImageFile(path)
+// AddImageReader decodes the image read from r within DefaultDecodeLimits, with DefaultDecodeOptions, and adds it to the index with the URI.
+func AddImageReader(idx Index, r io.Reader, uri string, attrs interface{}) (embedders.Vector, error) {
+	return AddImageReaderContext(context.Background(), idx, r, uri, attrs)
+}
+
+func AddImageReaderContext(ctx context.Context, idx Index, r io.Reader, uri string, attrs interface{}) (
+	embedders.Vector, error) {
+	img, err := DecodeImage(r, DefaultDecodeLimits, DefaultDecodeOptions)
 	if err != nil {
-		return "", nil, -1, fmt.Errorf("failed to read %v, %w", path, err)
+		return nil, fmt.Errorf("failed to read %v, %w", uri, err)
+	}
+	return idx.AddImageContext(ctx, img, uri, attrs)
+}
+
+// AddImageBytes is the same as AddImageReader, but the image is read from data.
+func AddImageBytes(idx Index, data []byte, uri string, attrs interface{}) (embedders.Vector, error) {
+	return AddImageReaderContext(context.Background(), idx, bytes.NewReader(data), uri, attrs)
+}
+
+func AddImageBytesContext(ctx context.Context, idx Index, data []byte, uri string, attrs interface{}) (
+	embedders.Vector, error) {
+	return AddImageReaderContext(ctx, idx, bytes.NewReader(data), uri, attrs)
+}
+
+// NearestByReader decodes the image read from r within DefaultDecodeLimits, with DefaultDecodeOptions, and searches for the nearest one to it.
+func NearestByReader(idx Index, r io.Reader) (uri string, attrs interface{}, distance float64, err error) {
+	return NearestByReaderContext(context.Background(), idx, r)
+}
+
+func NearestByReaderContext(ctx context.Context, idx Index, r io.Reader) (
+	uri string, attrs interface{}, distance float64, err error) {
+	img, err := DecodeImage(r, DefaultDecodeLimits, DefaultDecodeOptions)
+	if err != nil {
+		return "", nil, -1, fmt.Errorf("failed to read image, %w", err)
 	}
-	return idx.Nearest(img)
+	return idx.NearestContext(ctx, img)
+}
+
+// NearestByBytes is the same as NearestByReader, but the image is read from data.
+func NearestByBytes(idx Index, data []byte) (uri string, attrs interface{}, distance float64, err error) {
+	return NearestByReaderContext(context.Background(), idx, bytes.NewReader(data))
+}
+
+func NearestByBytesContext(ctx context.Context, idx Index, data []byte) (
+	uri string, attrs interface{}, distance float64, err error) {
+	return NearestByReaderContext(ctx, idx, bytes.NewReader(data))
 }
 
 func NewPersistentCompositeIndex(width, height int, dialector gorm.Dialector) (Index, error) {
@@ -0,0 +1,171 @@
+package imgidx
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alef-ru/imgidx/embedders"
+	"github.com/stretchr/testify/assert"
+	"gonum.org/v1/gonum/spatial/kdtree"
+)
+
+// newLineIndex returns an index of 1-dimensional vectors 0, 1, 2 ... n-1 with URIs "0", "1", "2" ... "n-1"
+func newLineIndex(t *testing.T, n int, opts ...KDTreeOption) *kDTreeIndex {
+	idx, err := NewKDTreeImageIndex(embedders.NewAspectRatioEmbedder(), opts...)
+	assert.NoError(t, err, "Failed to create index")
+	batch := make([]ImgEmbed, n)
+	for i := range batch {
+		batch[i] = ImgEmbed{URI: strconv.Itoa(i), Vector: kdtree.Point{float64(i)}}
+	}
+	assert.NoError(t, idx.AddVectors(batch))
+	return idx.(*kDTreeIndex)
+}
+
+func TestKDTreeIndexTombstones(t *testing.T) {
+	idx := newLineIndex(t, 10, WithCompactionThreshold(0.5))
+
+	removed, err := idx.RemoveURI("0", "1", "2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0", "1", "2"}, removed)
+	stats := idx.Stats()
+	assert.Equal(t, 10, stats.Nodes, "Removed images were expected to stay in the tree")
+	assert.Equal(t, 7, stats.Count)
+	assert.Equal(t, 7, idx.GetCount())
+
+	// Searches skip tombstones
+	found, err := idx.snap.Load().nearestSet(context.Background(), embedders.Vector{0}, kdtree.NewNKeeper(2), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []SearchResult{{URI: "3", Distance: 9}, {URI: "4", Distance: 16}}, found)
+
+	// A removed URI can be added again, its tombstone isn't confused with the new image
+	assert.NoError(t, idx.AddVector(embedders.Vector{9.5}, "0", "new"))
+	found, err = idx.snap.Load().nearestSet(context.Background(), embedders.Vector{0}, kdtree.NewDistKeeper(100), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, len(found))
+	assert.Equal(t, SearchResult{URI: "0", Attributes: "new", Distance: 9.5 * 9.5}, found[7])
+
+	// Once the fraction of tombstones exceeds the threshold, the tree is compacted in the background
+	_, err = idx.RemoveURI("3", "4", "5")
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return idx.Stats().Nodes == 5
+	}, time.Second, time.Millisecond, "The tree was expected to be compacted")
+	assert.Equal(t, 5, idx.GetCount())
+	_, attrs, ok := idx.Get("0")
+	assert.True(t, ok)
+	assert.Equal(t, "new", attrs)
+}
+
+func TestKDTreeIndexZeroCompactionThreshold(t *testing.T) {
+	idx := newLineIndex(t, 10, WithCompactionThreshold(0))
+	_, err := idx.RemoveURI("0")
+	assert.NoError(t, err)
+	assert.Equal(t, 9, idx.Stats().Nodes, "The tree was expected to be rebuilt")
+}
+
+// addLineOneByOne adds vectors from..to-1 to the index one by one, so the tree degenerates into a list
+func addLineOneByOne(t *testing.T, idx Index, from, to int) {
+	for i := from; i < to; i++ {
+		assert.NoError(t, idx.AddVector(embedders.Vector{float64(i)}, strconv.Itoa(i), nil))
+	}
+}
+
+func TestKDTreeIndexRebalance(t *testing.T) {
+	idx := newLineIndex(t, 0, WithRebalanceFactor(0))
+	addLineOneByOne(t, idx, 0, 100)
+	assert.Equal(t, IndexStats{Count: 100, Nodes: 100, Depth: 100}, idx.Stats())
+
+	idx.Rebalance()
+	stats := idx.Stats()
+	assert.Equal(t, 100, stats.Nodes)
+	// kdtree picks approximate medians, so the tree is not perfectly balanced, its depth would be 7 otherwise
+	assert.LessOrEqual(t, stats.Depth, 10, "The tree was expected to be balanced")
+}
+
+func TestKDTreeIndexAutoRebalance(t *testing.T) {
+	idx := newLineIndex(t, 0)
+	addLineOneByOne(t, idx, 0, 1000)
+	assert.Eventually(t, func() bool {
+		stats := idx.Stats()
+		return stats.Depth <= defaultRebalanceFactor*10 && stats.Nodes == 1000
+	}, time.Second, time.Millisecond, "The tree was expected to be rebalanced")
+	found, err := idx.snap.Load().nearestSet(context.Background(), embedders.Vector{500.2}, kdtree.NewNKeeper(3), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(found))
+	assert.Equal(t, "500", found[0].URI)
+}
+
+func TestKDTreeIndexAddVectorsRebuild(t *testing.T) {
+	idx := newLineIndex(t, 100, WithRebalanceFactor(0))
+	builds := idx.builds
+
+	// A small batch is inserted into the tree, the tree isn't rebuilt
+	assert.NoError(t, idx.AddVectors([]ImgEmbed{
+		{URI: "a", Vector: kdtree.Point{10.5}},
+		{URI: "b", Vector: kdtree.Point{20.5}},
+	}))
+	assert.Equal(t, builds, idx.builds, "The tree wasn't expected to be rebuilt")
+	assert.Equal(t, 102, idx.Stats().Nodes)
+	found, err := idx.snap.Load().nearestSet(context.Background(), embedders.Vector{20.4}, kdtree.NewNKeeper(1), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", found[0].URI)
+
+	// A batch comparable to the tree in size is built into a new tree with it
+	batch := make([]ImgEmbed, 60)
+	for i := range batch {
+		batch[i] = ImgEmbed{URI: "new" + strconv.Itoa(i), Vector: kdtree.Point{float64(100 + i)}}
+	}
+	assert.NoError(t, idx.AddVectors(batch))
+	assert.Equal(t, builds+1, idx.builds, "The tree was expected to be rebuilt")
+	assert.Equal(t, IndexStats{Count: 162, Nodes: 162, Depth: idx.Stats().Depth}, idx.Stats())
+	assert.LessOrEqual(t, idx.Stats().Depth, 12, "The tree was expected to be balanced")
+}
+
+func TestKDTreeIndexSnapshotIsImmutable(t *testing.T) {
+	idx := newLineIndex(t, 10, WithRebalanceFactor(0))
+	snap := idx.snap.Load()
+
+	assert.NoError(t, idx.AddVector(embedders.Vector{0.5}, "new", nil))
+	assert.NoError(t, idx.UpdateAttributes("1", "updated"))
+	_, err := idx.RemoveURI("0")
+	assert.NoError(t, err)
+
+	// The writes above produced new snapshots, the old one still sees the index as it was
+	found, err := snap.nearestSet(context.Background(), embedders.Vector{0}, kdtree.NewNKeeper(2), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []SearchResult{{URI: "0", Distance: 0}, {URI: "1", Distance: 1}}, found)
+	assert.Equal(t, 10, snap.tree.Count)
+	assert.Equal(t, 10, snap.byURI.len())
+
+	found, err = idx.snap.Load().nearestSet(context.Background(), embedders.Vector{0}, kdtree.NewNKeeper(2), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []SearchResult{{URI: "new", Distance: 0.25}, {URI: "1", Attributes: "updated", Distance: 1}}, found)
+}
+
+func TestURIMap(t *testing.T) {
+	m := newURIMap([]ImgEmbed{{URI: "a"}, {URI: "b"}})
+	c := ImgEmbed{URI: "c"}
+	m2 := m.with(map[string]*ImgEmbed{"a": nil, "c": &c})
+	_, ok := m.get("a")
+	assert.True(t, ok)
+	_, ok = m2.get("a")
+	assert.False(t, ok)
+	_, ok = m2.get("c")
+	assert.True(t, ok)
+	assert.Equal(t, 2, m.len())
+	assert.Equal(t, 2, m2.len())
+
+	// Once the overlay grows large, it's merged into the base
+	changes := make(map[string]*ImgEmbed)
+	for i := 0; i < 2*minOverlaySize; i++ {
+		embd := ImgEmbed{URI: strconv.Itoa(i)}
+		changes[embd.URI] = &embd
+	}
+	m3 := m2.with(changes)
+	assert.Equal(t, 0, len(m3.overlay))
+	assert.Equal(t, 2+2*minOverlaySize, m3.len())
+	assert.Equal(t, 2+2*minOverlaySize, len(m3.values()))
+	assert.Equal(t, 2, m2.len(), "The original map was expected to remain intact")
+}
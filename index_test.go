@@ -1,6 +1,8 @@
 package imgidx_test
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/alef-ru/imgidx"
 	"github.com/alef-ru/imgidx/embedders"
@@ -16,6 +18,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func addPokemonsToIndex(t *testing.T, idx imgidx.Index) {
@@ -144,6 +147,162 @@ func TestIndexWeekMatch(t *testing.T) {
 
 }
 
+// Try to find rotated and mirrored copies of an image with a flip- and rotation-invariant embedder
+// rotate90 returns a copy of the image rotated by 90 degrees clockwise
+func rotate90(img image.Image) image.Image {
+	b := img.Bounds()
+	res := image.NewRGBA(image.Rect(0, 0, b.Dy(), b.Dx()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			res.Set(b.Max.Y-1-y, x-b.Min.X, img.At(x, y))
+		}
+	}
+	return res
+}
+
+// mirror returns a copy of the image mirrored horizontally
+func mirror(img image.Image) image.Image {
+	b := img.Bounds()
+	res := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			res.Set(b.Max.X-1-x, y-b.Min.Y, img.At(x, y))
+		}
+	}
+	return res
+}
+
+func TestIndexDihedralInvariantMatch(t *testing.T) {
+	haystack, err := imgidx.NewKDTreeImageIndex(embedders.NewDihedralInvariantEmbedder(newEmbedder()))
+	assert.NoError(t, err)
+	addPokemonsToIndex(t, haystack)
+	img, err := loadImage("testdata/pokemon/abomasnow.png")
+	assert.NoError(t, err)
+	for _, needle := range []image.Image{rotate90(img), mirror(img)} {
+		got, _, dist, err := haystack.Nearest(needle)
+		assert.NoError(t, err)
+		assert.Equal(t, "abomasnow.png", filepath.Base(got))
+		assert.Less(t, dist, 0.001)
+	}
+}
+
+func TestIndexDihedralInvariantMatchAlteredImages(t *testing.T) {
+	// The rotated and mirrored copies of the altered images are as close to the original as the copies themselves
+	plain, err := imgidx.NewKDTreeImageIndex(embedders.NewPHashEmbedder(8))
+	assert.NoError(t, err)
+	addPokemonsToIndex(t, plain)
+	haystack, err := imgidx.NewKDTreeImageIndex(embedders.NewDihedralInvariantEmbedder(embedders.NewPHashEmbedder(8)))
+	assert.NoError(t, err)
+	addPokemonsToIndex(t, haystack)
+	for _, needlePath := range []string{"testdata/compressed_abomasnow.jpg", "testdata/distorted_abomasnow.jpg"} {
+		needle, err := loadImage(needlePath)
+		assert.NoError(t, err)
+		got, _, expected, err := plain.Nearest(needle)
+		assert.NoError(t, err)
+		assert.Equal(t, "abomasnow.png", filepath.Base(got))
+		for _, variant := range []image.Image{needle, rotate90(needle), mirror(needle), rotate90(rotate90(mirror(needle)))} {
+			got, _, dist, err := haystack.Nearest(variant)
+			assert.NoError(t, err)
+			assert.Equal(t, "abomasnow.png", filepath.Base(got), needlePath)
+			assert.Equal(t, expected, dist, needlePath)
+
+			found, err := haystack.NearestK(variant, 5)
+			assert.NoError(t, err)
+			assert.Equal(t, 5, len(found))
+			assert.Equal(t, "abomasnow.png", filepath.Base(found[0].URI))
+			uris := map[string]bool{}
+			for i, r := range found {
+				assert.False(t, uris[r.URI], "%s is found twice", r.URI)
+				uris[r.URI] = true
+				if i > 0 {
+					assert.LessOrEqual(t, found[i-1].Distance, r.Distance)
+				}
+			}
+
+			within, err := haystack.WithinDistance(variant, expected)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(within))
+		}
+	}
+}
+
+func TestIndexNearestK(t *testing.T) {
+	haystack := newKD3Index(t)
+	addPokemonsToIndex(t, haystack)
+	needlePath := "testdata/compressed_abomasnow.jpg"
+	needle, err := loadImage(needlePath)
+	if err != nil {
+		t.Fatalf("failed to load image %v : %v", needlePath, err)
+	}
+
+	got, err := haystack.NearestK(needle, 5)
+	assert.NoError(t, err, "Failed to find nearest images")
+	assert.Equal(t, 5, len(got))
+	assert.Equal(t, "abomasnow.png", filepath.Base(got[0].URI))
+	assert.Equal(t, "abomasnow.png", got[0].Attributes)
+	for i := 1; i < len(got); i++ {
+		assert.LessOrEqual(t, got[i-1].Distance, got[i].Distance, "Results must be ordered by distance")
+	}
+	_, _, dist, err := haystack.Nearest(needle)
+	assert.NoError(t, err, "Failed to find nearest image")
+	assert.Equal(t, dist, got[0].Distance)
+
+	got, err = haystack.NearestK(needle, haystack.GetCount()+10)
+	assert.NoError(t, err, "Failed to find nearest images")
+	assert.Equal(t, haystack.GetCount(), len(got), "All the images were expected to be returned")
+
+	_, err = haystack.NearestK(needle, 0)
+	assert.Error(t, err, "k=0 was expected to cause an error")
+
+	got, err = newKD3Index(t).NearestK(needle, 3)
+	assert.NoError(t, err, "Empty index was not expected to cause an error")
+	assert.Empty(t, got)
+}
+
+func TestIndexNearestMatching(t *testing.T) {
+	haystack := newKD3Index(t)
+	addPokemonsToIndex(t, haystack)
+	needlePath := "testdata/compressed_abomasnow.jpg"
+	needle, err := loadImage(needlePath)
+	if err != nil {
+		t.Fatalf("failed to load image %v : %v", needlePath, err)
+	}
+	notAbomasnow := func(vec embedders.Vector, uri string, attrs interface{}) bool {
+		return attrs != "abomasnow.png"
+	}
+
+	// Without the filter, the search matches abomasnow.png
+	uri, attrs, dist, err := haystack.NearestMatching(needle,
+		func(vec embedders.Vector, uri string, attrs interface{}) bool { return true })
+	assert.NoError(t, err)
+	assert.Equal(t, "abomasnow.png", attrs)
+	assert.True(t, strings.HasSuffix(uri, "abomasnow.png"))
+	assert.Less(t, dist, 0.025)
+
+	// The filter excludes the closest image, so the next nearest one must be found
+	_, attrs, dist, err = haystack.NearestMatching(needle, notAbomasnow)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "abomasnow.png", attrs)
+	_, err = haystack.Remove(func(vec embedders.Vector, uri string, attrs interface{}) bool {
+		return !notAbomasnow(vec, uri, attrs)
+	})
+	assert.NoError(t, err)
+	_, wantAttrs, wantDist, err := haystack.Nearest(needle)
+	assert.NoError(t, err)
+	assert.Equal(t, wantAttrs, attrs, "The result must be the same as if the filtered out image was removed")
+	assert.Equal(t, wantDist, dist)
+
+	// The filter accepts only an image that is far from the needle
+	_, attrs, _, err = haystack.NearestMatching(needle,
+		func(vec embedders.Vector, uri string, attrs interface{}) bool { return attrs == "abra.png" })
+	assert.NoError(t, err)
+	assert.Equal(t, "abra.png", attrs)
+
+	_, _, _, err = haystack.NearestMatching(needle,
+		func(vec embedders.Vector, uri string, attrs interface{}) bool { return false })
+	assert.ErrorIs(t, err, imgidx.ErrNotFound)
+}
+
 func generateTestImages(t *testing.T) imgidx.Index {
 	e := embedders.NewAspectRatioEmbedder()
 	idx, err := imgidx.NewKDTreeImageIndex(e)
@@ -221,6 +380,239 @@ func TestIndexRemove(t *testing.T) {
 	}
 }
 
+func TestIndexWithinDistance(t *testing.T) {
+	idx := generateTestImages(t)
+	needle := image.NewRGBA(image.Rect(0, 0, 101, 99))
+
+	tests := []struct {
+		name    string
+		maxDist float64
+		want    []string
+		wantErr bool
+	}{
+		{"negative distance", -1, nil, true},
+		{"nothing within distance", 0.0001, []string{}, false},
+		{"almost square images", 0.01, []string{"1:1 image", "almost 1:1 vertical image"}, false},
+		{"all images", 1, []string{"1:1 image", "almost 1:1 vertical image", "2:1 image", "1:2 image"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := idx.WithinDistance(needle, tt.maxDist)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("kDTreeIndex.WithinDistance() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			uris := make([]string, 0, len(got))
+			for _, r := range got {
+				assert.LessOrEqual(t, r.Distance, tt.maxDist)
+				uris = append(uris, r.URI)
+			}
+			assert.Equal(t, tt.want, uris)
+		})
+	}
+}
+
+func TestWithinDistanceByFileAndURL(t *testing.T) {
+	server := runTestImgHttpServer()
+	defer server.Close()
+	idx := newKD3Index(t)
+	addPokemonsToIndex(t, idx)
+
+	got, err := imgidx.WithinDistanceByFile(idx, "testdata/compressed_abomasnow.jpg", 0.025)
+	assert.NoError(t, err, "Failed to search images by file")
+	assert.Equal(t, 1, len(got), "Exactly one image was expected to be found")
+	assert.Equal(t, "abomasnow.png", got[0].Attributes)
+
+	got, err = imgidx.WithinDistanceByURL(idx, server.URL+"/abra.png", 0)
+	assert.NoError(t, err, "Failed to search images by URL")
+	assert.Equal(t, 1, len(got), "Exactly one image was expected to be found")
+	assert.Equal(t, "abra.png", got[0].Attributes)
+
+	_, err = imgidx.WithinDistanceByURL(idx, server.URL+"/does-not-exist.png", 0)
+	assert.Error(t, err)
+}
+
+func TestIndexGetContainsRemoveURI(t *testing.T) {
+	idx := generateTestImages(t)
+	vec, err := idx.AddImage(image.NewRGBA(image.Rect(0, 0, 300, 100)), "3:1 image", "attrs")
+	assert.NoError(t, err)
+
+	got, attrs, ok := idx.Get("3:1 image")
+	assert.True(t, ok, "The image was expected to be found")
+	assert.Equal(t, vec, got)
+	assert.Equal(t, "attrs", attrs)
+	assert.True(t, idx.Contains("3:1 image"))
+	got[0] = 100 // Modifying the returned vector must not affect the index
+	got, _, _ = idx.Get("3:1 image")
+	assert.Equal(t, vec, got)
+
+	_, _, ok = idx.Get("unknown image")
+	assert.False(t, ok, "The image was not expected to be found")
+	assert.False(t, idx.Contains("unknown image"))
+
+	removed, err := idx.RemoveURI("3:1 image", "1:1 image", "unknown image")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3:1 image", "1:1 image"}, removed)
+	assert.Equal(t, 3, idx.GetCount())
+	assert.False(t, idx.Contains("3:1 image"))
+	assert.False(t, idx.Contains("1:1 image"))
+	uri, _, _, err := idx.Nearest(image.NewRGBA(image.Rect(0, 0, 100, 100)))
+	assert.NoError(t, err)
+	assert.Equal(t, "almost 1:1 vertical image", uri)
+
+	removed, err = idx.RemoveURI("unknown image")
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+	assert.Equal(t, 3, idx.GetCount())
+
+	// Removed URI can be added again
+	_, err = idx.AddImage(image.NewRGBA(image.Rect(0, 0, 100, 100)), "1:1 image", nil)
+	assert.NoError(t, err)
+	assert.True(t, idx.Contains("1:1 image"))
+}
+
+func TestIndexUpdateAttributes(t *testing.T) {
+	idx := generateTestImages(t)
+	needle := image.NewRGBA(image.Rect(0, 0, 100, 100))
+
+	assert.NoError(t, idx.UpdateAttributes("1:1 image", "square"))
+	_, attrs, ok := idx.Get("1:1 image")
+	assert.True(t, ok)
+	assert.Equal(t, "square", attrs)
+	_, attrs, _, err := idx.Nearest(needle)
+	assert.NoError(t, err)
+	assert.Equal(t, "square", attrs)
+	found, err := idx.NearestK(needle, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "square", found[0].Attributes)
+	uri, _, _, err := idx.NearestMatching(needle,
+		func(vec embedders.Vector, uri string, attrs interface{}) bool { return attrs == "square" })
+	assert.NoError(t, err)
+	assert.Equal(t, "1:1 image", uri)
+	removed, err := idx.Remove(func(vec embedders.Vector, uri string, attrs interface{}) bool {
+		return attrs == "square"
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1:1 image"}, removed)
+
+	err = idx.UpdateAttributes("1:1 image", "square")
+	assert.ErrorIs(t, err, imgidx.ErrNotFound)
+	assert.False(t, idx.Contains("1:1 image"), "UpdateAttributes must not add images")
+}
+
+func TestIndexUpsertImage(t *testing.T) {
+	idx := generateTestImages(t)
+	cnt := idx.GetCount()
+	square := image.NewRGBA(image.Rect(0, 0, 100, 100))
+
+	// Replace the square image with a wide one
+	vec, err := idx.UpsertImage(image.NewRGBA(image.Rect(0, 0, 400, 100)), "1:1 image", "wide")
+	assert.NoError(t, err)
+	assert.Equal(t, cnt, idx.GetCount())
+	got, attrs, _ := idx.Get("1:1 image")
+	assert.Equal(t, vec, got)
+	assert.Equal(t, "wide", attrs)
+	uri, _, _, err := idx.Nearest(square)
+	assert.NoError(t, err)
+	assert.Equal(t, "almost 1:1 vertical image", uri, "The old vector was expected to be replaced")
+	uri, _, _, err = idx.Nearest(image.NewRGBA(image.Rect(0, 0, 400, 100)))
+	assert.NoError(t, err)
+	assert.Equal(t, "1:1 image", uri)
+
+	// Upsert with the same vector only changes attributes
+	_, err = idx.UpsertImage(image.NewRGBA(image.Rect(0, 0, 800, 200)), "1:1 image", "still wide")
+	assert.NoError(t, err)
+	_, attrs, _ = idx.Get("1:1 image")
+	assert.Equal(t, "still wide", attrs)
+
+	// Upsert of a new URI adds the image
+	_, err = idx.UpsertImage(square, "another square", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, cnt+1, idx.GetCount())
+	uri, _, _, err = idx.Nearest(square)
+	assert.NoError(t, err)
+	assert.Equal(t, "another square", uri)
+
+	assert.Error(t, idx.UpsertVector(embedders.Vector{1, 2}, "1:1 image", nil),
+		"Vector of a wrong size must be rejected")
+}
+
+func loadPokemonItems(t *testing.T) []imgidx.ImageItem {
+	imgDirPath := "./testdata/pokemon"
+	files, err := os.ReadDir(imgDirPath)
+	if err != nil {
+		t.Fatalf("failed to read files in %s : %v", imgDirPath, err)
+	}
+	items := make([]imgidx.ImageItem, 0, len(files))
+	for _, file := range files {
+		img, err := loadImage(path.Join(imgDirPath, file.Name()))
+		if err != nil {
+			t.Fatalf("failed to load image %s : %v", file.Name(), err)
+		}
+		items = append(items, imgidx.ImageItem{Image: img, URI: file.Name(), Attributes: file.Name()})
+	}
+	return items
+}
+
+func TestIndexAddImages(t *testing.T) {
+	items := loadPokemonItems(t)
+	idx := newKD3Index(t)
+	vecs, err := idx.AddImages(items)
+	assert.NoError(t, err, "Failed to add images")
+	assert.Equal(t, len(items), len(vecs))
+	assert.Equal(t, len(items), idx.GetCount())
+
+	// The vectors must be the same as if the images were added one by one
+	oneByOne := newKD3Index(t)
+	for i, item := range items {
+		vec, err := oneByOne.AddImage(item.Image, item.URI, item.Attributes)
+		assert.NoError(t, err)
+		assert.Equal(t, vec, vecs[i])
+	}
+
+	needle, err := loadImage("testdata/compressed_abomasnow.jpg")
+	assert.NoError(t, err)
+	uri, attrs, _, err := idx.Nearest(needle)
+	assert.NoError(t, err)
+	assert.Equal(t, "abomasnow.png", uri)
+	assert.Equal(t, "abomasnow.png", attrs)
+
+	// Batch with an URI which is already in the index
+	extra := imgidx.ImageItem{Image: image.NewRGBA(image.Rect(0, 0, 10, 10)), URI: "extra.png"}
+	_, err = idx.AddImages([]imgidx.ImageItem{extra, items[0]})
+	assert.ErrorIs(t, err, imgidx.URIAlreadyExists{})
+	assert.False(t, idx.Contains("extra.png"), "None of the images was expected to be added")
+
+	// Batch with repeated URIs
+	_, err = idx.AddImages([]imgidx.ImageItem{extra, extra})
+	assert.ErrorIs(t, err, imgidx.URIAlreadyExists{})
+	assert.Equal(t, len(items), idx.GetCount())
+
+	// Batch with an image that can't be embedded
+	_, err = idx.AddImages([]imgidx.ImageItem{extra, {Image: image.NewRGBA(image.Rect(0, 0, 0, 0)), URI: "empty.png"}})
+	assert.ErrorContains(t, err, "empty.png")
+	assert.Equal(t, len(items), idx.GetCount())
+
+	err = idx.AddVectors([]imgidx.ImgEmbed{{URI: "short.png", Vector: []float64{1}}})
+	assert.Error(t, err, "Vector of a wrong size must be rejected")
+}
+
+func TestIndexStats(t *testing.T) {
+	idx := newKD3Index(t)
+	assert.Equal(t, imgidx.IndexStats{}, idx.Stats())
+	addPokemonsToIndex(t, idx)
+	stats := idx.Stats()
+	assert.Equal(t, idx.GetCount(), stats.Count)
+	assert.Equal(t, idx.GetCount(), stats.Nodes)
+	assert.Greater(t, stats.Depth, 0)
+
+	idx.Rebalance()
+	assert.LessOrEqual(t, idx.Stats().Depth, stats.Depth, "Rebalancing was not expected to make the tree deeper")
+	assert.Equal(t, stats.Nodes, idx.Stats().Nodes)
+}
+
 func TestIndexConcurrentWrite(t *testing.T) {
 	const iterations = 100
 	deletionResults := make(chan []string, iterations)
@@ -271,6 +663,61 @@ func TestIndexConcurrentWrite(t *testing.T) {
 	}
 }
 
+// Nearest must not observe a half-done removal: while the extra images come and go,
+// the original images remain in the index, so the needle must always be found.
+// Run it with -race.
+func TestIndexConcurrentReadWrite(t *testing.T) {
+	const iterations = 100
+	extraImage := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	removeExtraImages := func(vec embedders.Vector, uri string, attrs interface{}) bool {
+		return attrs == "extra"
+	}
+	needlePath := "testdata/compressed_abomasnow.jpg"
+	needle, err := loadImage(needlePath)
+	if err != nil {
+		t.Fatalf("failed to load image %v : %v", needlePath, err)
+	}
+	idx := newKD3Index(t)
+	addPokemonsToIndex(t, idx)
+	originalIdxLen := idx.GetCount()
+	var wg sync.WaitGroup
+	wg.Add(iterations * 3)
+	for i := 0; i < iterations; i++ {
+		go func(i int) {
+			defer wg.Done()
+			uri := fmt.Sprintf("files://./image_%d", i)
+			_, err := idx.AddImage(extraImage, uri, "extra")
+			if err != nil {
+				panic("Failed to add extra image to index")
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, err := idx.Remove(removeExtraImages)
+			if err != nil {
+				panic("Failed to remove extra images from index")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			got, _, _, err := idx.Nearest(needle)
+			if err != nil {
+				panic(fmt.Sprintf("Failed to find nearest image : %v", err))
+			}
+			if filepath.Base(got) != "abomasnow.png" {
+				panic(fmt.Sprintf("Failed to find nearest image, got %s, want abomasnow.png", got))
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := idx.Remove(removeExtraImages); err != nil {
+		t.Fatalf("Failed to remove extra images from index, : %v", err)
+	}
+	if idx.GetCount() != originalIdxLen {
+		t.Fatalf("%v images was expected to be in index, %v in fact", originalIdxLen, idx.GetCount())
+	}
+}
+
 func TestAddImageUrl(t *testing.T) {
 	server := runTestImgHttpServer()
 	defer server.Close()
@@ -293,6 +740,89 @@ func TestAddImageUrl(t *testing.T) {
 	}
 }
 
+func TestIndexContextCancelled(t *testing.T) {
+	idx := newKD3Index(t)
+	addPokemonsToIndex(t, idx)
+	cnt := idx.GetCount()
+	img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := idx.AddImageContext(ctx, img, "new.png", nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = idx.AddImagesContext(ctx, loadPokemonItems(t))
+	assert.ErrorIs(t, err, context.Canceled)
+	_, _, _, err = idx.NearestContext(ctx, img)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = idx.NearestKContext(ctx, img, 3)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = idx.WithinDistanceContext(ctx, img, 1)
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = idx.RemoveContext(ctx, func(vec embedders.Vector, uri string, attrs interface{}) bool { return true })
+	assert.ErrorIs(t, err, context.Canceled)
+	_, err = idx.RemoveURIContext(ctx, "files://./testdata/pokemon/abra.png")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, cnt, idx.GetCount(), "Nothing was expected to change")
+	assert.False(t, idx.Contains("new.png"))
+
+	_, err = idx.AddImageContext(context.Background(), img, "new.png", nil)
+	assert.NoError(t, err)
+}
+
+func TestNearestByURLContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done() // never responds
+	}))
+	defer server.Close()
+	idx := newKD3Index(t)
+	addPokemonsToIndex(t, idx)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, _, err := imgidx.NearestByURLContext(ctx, idx, server.URL+"/abra.png")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, err = imgidx.AddImageUrlContext(ctx, idx, server.URL+"/abra.png", nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestAddImageReaderAndBytes(t *testing.T) {
+	imgPath := "testdata/pokemon/abra.png"
+	data, err := os.ReadFile(imgPath)
+	assert.NoError(t, err)
+	idx := newKD3Index(t)
+	fileVec, err := imgidx.AddImageFile(idx, imgPath, "from file")
+	assert.NoError(t, err)
+	readerVec, err := imgidx.AddImageReader(idx, bytes.NewReader(data), "from reader", nil)
+	assert.NoError(t, err)
+	bytesVec, err := imgidx.AddImageBytes(idx, data, "from bytes", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, fileVec, readerVec)
+	assert.Equal(t, fileVec, bytesVec)
+
+	_, err = imgidx.AddImageBytes(idx, data, "from bytes", nil)
+	assert.ErrorIs(t, err, imgidx.URIAlreadyExists{})
+	_, err = imgidx.AddImageBytes(idx, pngBomb(t, 100000, 100000), "bomb", nil)
+	assert.ErrorIs(t, err, imgidx.ErrImageTooLarge)
+}
+
+func TestNearestByReaderAndBytes(t *testing.T) {
+	idx := newKD3Index(t)
+	addPokemonsToIndex(t, idx)
+	data, err := os.ReadFile("testdata/compressed_abomasnow.jpg")
+	assert.NoError(t, err)
+
+	uri, _, dist, err := imgidx.NearestByReader(idx, bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, "abomasnow.png", filepath.Base(uri))
+	assert.Less(t, dist, 0.025)
+	uri, _, _, err = imgidx.NearestByBytes(idx, data)
+	assert.NoError(t, err)
+	assert.Equal(t, "abomasnow.png", filepath.Base(uri))
+
+	_, _, _, err = imgidx.NearestByBytes(idx, []byte("not an image"))
+	assert.ErrorContains(t, err, "image: unknown format")
+}
+
 func runTestImgHttpServer() *httptest.Server {
 	server := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
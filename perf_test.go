@@ -2,10 +2,13 @@ package imgidx
 
 import (
 	_ "image/jpeg"
+	"math/rand"
 	"strconv"
 	"testing"
 
+	"github.com/alef-ru/imgidx/embedders"
 	"github.com/stretchr/testify/assert"
+	"gonum.org/v1/gonum/spatial/kdtree"
 )
 
 func BenchmarkComposite_Img2Vec_Jpeg(b *testing.B) {
@@ -20,3 +23,39 @@ func BenchmarkComposite_Img2Vec_Jpeg(b *testing.B) {
 		assert.NoError(b, err)
 	}
 }
+
+// benchmarkRemoveURI removes an image from the index of 10000 images and adds it back on each iteration
+func benchmarkRemoveURI(b *testing.B, opts ...KDTreeOption) {
+	const size = 10000
+	e := embedders.NewLowResolutionEmbedder(4, 4)
+	idx, err := NewKDTreeImageIndex(e, opts...)
+	assert.NoError(b, err, "Failed to create index")
+	rnd := rand.New(rand.NewSource(1))
+	batch := make([]ImgEmbed, size)
+	for i := range batch {
+		vec := make(kdtree.Point, e.Dims())
+		for j := range vec {
+			vec[j] = rnd.Float64()
+		}
+		batch[i] = ImgEmbed{URI: strconv.Itoa(i), Vector: vec}
+	}
+	assert.NoError(b, idx.AddVectors(batch))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		embd := batch[i%size]
+		_, err := idx.RemoveURI(embd.URI)
+		assert.NoError(b, err)
+		assert.NoError(b, idx.AddVector(embedders.Vector(embd.Vector), embd.URI, nil))
+	}
+}
+
+// Rebuilding the tree on every removal vs. tombstones with background compaction:
+// BenchmarkRemoveURI_Rebuild              31          36630330 ns/op         8161326 B/op      167423 allocs/op
+// BenchmarkRemoveURI_Tombstones       219710              4796 ns/op             899 B/op          14 allocs/op
+func BenchmarkRemoveURI_Rebuild(b *testing.B) {
+	benchmarkRemoveURI(b, WithCompactionThreshold(0))
+}
+
+func BenchmarkRemoveURI_Tombstones(b *testing.B) {
+	benchmarkRemoveURI(b)
+}
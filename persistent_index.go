@@ -1,6 +1,7 @@
 package imgidx
 
 import (
+	"context"
 	"fmt"
 	"github.com/alef-ru/imgidx/embedders"
 	"gonum.org/v1/gonum/spatial/kdtree"
@@ -9,13 +10,17 @@ import (
 	"sync"
 )
 
+// insertBatchSize is the number of rows inserted into the DB by a single statement.
+// It keeps the number of statement parameters below SQLite's limit.
+const insertBatchSize = 100
+
 type PersistentIndex struct {
 	db    *gorm.DB
 	inIdx Index
 	lock  sync.Mutex
 }
 
-func (idx *PersistentIndex) saveVec(vec embedders.Vector, uri string, attrs interface{}) error {
+func (idx *PersistentIndex) saveVec(ctx context.Context, vec embedders.Vector, uri string, attrs interface{}) error {
 	idx.lock.Lock()
 	defer idx.lock.Unlock()
 	embed := ImgEmbed{
@@ -23,7 +28,7 @@ func (idx *PersistentIndex) saveVec(vec embedders.Vector, uri string, attrs inte
 		Vector:     kdtree.Point(vec),
 		Attributes: attrs,
 	}
-	result := idx.db.Create(&embed)
+	result := idx.db.WithContext(ctx).Create(&embed)
 	if result.Error != nil {
 		return fmt.Errorf("failed to save image embed to DB: %w", result.Error)
 	}
@@ -31,66 +36,293 @@ func (idx *PersistentIndex) saveVec(vec embedders.Vector, uri string, attrs inte
 }
 
 func (idx *PersistentIndex) AddImage(img image.Image, uri string, attrs interface{}) (embedders.Vector, error) {
-	vec, err := idx.inIdx.AddImage(img, uri, attrs)
+	return idx.AddImageContext(context.Background(), img, uri, attrs)
+}
+
+func (idx *PersistentIndex) AddImageContext(ctx context.Context, img image.Image, uri string, attrs interface{}) (
+	embedders.Vector, error) {
+	vec, err := idx.inIdx.AddImageContext(ctx, img, uri, attrs)
 	if err != nil {
 		return nil, err
 	}
-	err = idx.saveVec(vec, uri, attrs)
+	err = idx.saveVec(ctx, vec, uri, attrs)
 	if err != nil {
+		// Revert the in-memory index, so it remains consistent with the DB
+		_, _ = idx.inIdx.RemoveURI(uri)
 		return nil, err
 	}
 	return vec, nil
 }
 
 func (idx *PersistentIndex) AddVector(vec embedders.Vector, uri string, attrs interface{}) error {
-	if err := idx.saveVec(vec, uri, attrs); err != nil {
+	return idx.AddVectorContext(context.Background(), vec, uri, attrs)
+}
+
+func (idx *PersistentIndex) AddVectorContext(ctx context.Context, vec embedders.Vector, uri string,
+	attrs interface{}) error {
+	if err := idx.saveVec(ctx, vec, uri, attrs); err != nil {
 		return err
 	}
-	return idx.inIdx.AddVector(vec, uri, attrs)
+	return idx.inIdx.AddVectorContext(ctx, vec, uri, attrs)
+}
+
+func (idx *PersistentIndex) AddImages(items []ImageItem) ([]embedders.Vector, error) {
+	return idx.AddImagesContext(context.Background(), items)
+}
+
+func (idx *PersistentIndex) AddImagesContext(ctx context.Context, items []ImageItem) ([]embedders.Vector, error) {
+	vecs, err := idx.inIdx.AddImagesContext(ctx, items)
+	if err != nil {
+		return nil, err
+	}
+	batch := make([]ImgEmbed, len(items))
+	uris := make([]string, len(items))
+	for i, item := range items {
+		batch[i] = ImgEmbed{URI: item.URI, Vector: kdtree.Point(vecs[i]), Attributes: item.Attributes}
+		uris[i] = item.URI
+	}
+	if err := idx.saveVecs(ctx, batch); err != nil {
+		// Revert the in-memory index, so it remains consistent with the DB
+		_, _ = idx.inIdx.RemoveURI(uris...)
+		return nil, err
+	}
+	return vecs, nil
+}
+
+func (idx *PersistentIndex) AddVectors(batch []ImgEmbed) error {
+	return idx.AddVectorsContext(context.Background(), batch)
+}
+
+func (idx *PersistentIndex) AddVectorsContext(ctx context.Context, batch []ImgEmbed) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	return idx.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := createEmbeds(tx, batch); err != nil {
+			return err
+		}
+		// The in-memory index goes last, so the DB changes are rolled back if it fails
+		return idx.inIdx.AddVectorsContext(ctx, batch)
+	})
+}
+
+// saveVecs saves the batch of vectors to the DB in a single transaction
+func (idx *PersistentIndex) saveVecs(ctx context.Context, batch []ImgEmbed) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	return idx.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return createEmbeds(tx, batch)
+	})
+}
+
+// createEmbeds inserts the vectors into the DB in batches of insertBatchSize rows
+func createEmbeds(tx *gorm.DB, batch []ImgEmbed) error {
+	// gorm sets IDs and timestamps of the created rows, so the caller's embeds are copied to stay intact
+	rows := make([]ImgEmbed, len(batch))
+	for i, embd := range batch {
+		rows[i] = ImgEmbed{URI: embd.URI, Vector: embd.Vector, Attributes: embd.Attributes}
+	}
+	result := tx.CreateInBatches(rows, insertBatchSize)
+	if result.Error != nil {
+		return fmt.Errorf("failed to save image embeds to DB: %w", result.Error)
+	}
+	return nil
 }
 
 func (idx *PersistentIndex) Nearest(img image.Image) (string, interface{}, float64, error) {
 	return idx.inIdx.Nearest(img)
 }
 
+func (idx *PersistentIndex) NearestContext(ctx context.Context, img image.Image) (string, interface{}, float64, error) {
+	return idx.inIdx.NearestContext(ctx, img)
+}
+
+func (idx *PersistentIndex) NearestK(img image.Image, k int) ([]SearchResult, error) {
+	return idx.inIdx.NearestK(img, k)
+}
+
+func (idx *PersistentIndex) NearestKContext(ctx context.Context, img image.Image, k int) ([]SearchResult, error) {
+	return idx.inIdx.NearestKContext(ctx, img, k)
+}
+
+func (idx *PersistentIndex) WithinDistance(img image.Image, maxDist float64) ([]SearchResult, error) {
+	return idx.inIdx.WithinDistance(img, maxDist)
+}
+
+func (idx *PersistentIndex) WithinDistanceContext(ctx context.Context, img image.Image, maxDist float64) (
+	[]SearchResult, error) {
+	return idx.inIdx.WithinDistanceContext(ctx, img, maxDist)
+}
+
+func (idx *PersistentIndex) NearestMatching(img image.Image, f func(embedders.Vector, string, interface{}) bool) (
+	string, interface{}, float64, error) {
+	return idx.inIdx.NearestMatching(img, f)
+}
+
+func (idx *PersistentIndex) NearestMatchingContext(ctx context.Context, img image.Image,
+	f func(embedders.Vector, string, interface{}) bool) (string, interface{}, float64, error) {
+	return idx.inIdx.NearestMatchingContext(ctx, img, f)
+}
+
 func (idx *PersistentIndex) Remove(f func(embedders.Vector, string, interface{}) bool) ([]string, error) {
+	return idx.RemoveContext(context.Background(), f)
+}
+
+func (idx *PersistentIndex) RemoveContext(ctx context.Context, f func(embedders.Vector, string, interface{}) bool) (
+	[]string, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	removed, err := idx.inIdx.RemoveContext(ctx, f)
+	if err != nil || removed == nil {
+		return removed, err
+	}
+	// Unscoped, so the rows are deleted rather than soft-deleted, and their URIs may be added again
+	result := idx.db.WithContext(ctx).Unscoped().Where("uri in ?", removed).Delete(&ImgEmbed{})
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to remove %d images from db: %w", len(removed), result.Error)
+	}
+	return removed, nil
+}
+
+func (idx *PersistentIndex) RemoveURI(uris ...string) ([]string, error) {
+	return idx.RemoveURIContext(context.Background(), uris...)
+}
+
+func (idx *PersistentIndex) RemoveURIContext(ctx context.Context, uris ...string) ([]string, error) {
 	idx.lock.Lock()
 	defer idx.lock.Unlock()
-	removed, err := idx.inIdx.Remove(f)
+	removed, err := idx.inIdx.RemoveURIContext(ctx, uris...)
 	if err != nil || removed == nil {
 		return removed, err
 	}
-	result := idx.db.Where("uri in ?", removed).Delete(&ImgEmbed{})
+	// Unscoped, so the rows are deleted rather than soft-deleted, and their URIs may be added again
+	result := idx.db.WithContext(ctx).Unscoped().Where("uri in ?", removed).Delete(&ImgEmbed{})
 	if result.Error != nil {
 		return nil, fmt.Errorf("failed to remove %d images from db: %w", len(removed), result.Error)
 	}
 	return removed, nil
 }
 
+func (idx *PersistentIndex) UpdateAttributes(uri string, attrs interface{}) error {
+	return idx.UpdateAttributesContext(context.Background(), uri, attrs)
+}
+
+func (idx *PersistentIndex) UpdateAttributesContext(ctx context.Context, uri string, attrs interface{}) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	return idx.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&ImgEmbed{}).Where("uri = ?", uri).
+			Select("Attributes").Updates(&ImgEmbed{Attributes: attrs})
+		if result.Error != nil {
+			return fmt.Errorf("failed to update image embed in DB: %w", result.Error)
+		}
+		// The in-memory index goes last, so the DB changes are rolled back if it fails
+		return idx.inIdx.UpdateAttributesContext(ctx, uri, attrs)
+	})
+}
+
+func (idx *PersistentIndex) UpsertVector(vec embedders.Vector, uri string, attrs interface{}) error {
+	return idx.UpsertVectorContext(context.Background(), vec, uri, attrs)
+}
+
+func (idx *PersistentIndex) UpsertVectorContext(ctx context.Context, vec embedders.Vector, uri string,
+	attrs interface{}) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	return idx.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := upsertEmbed(tx, vec, uri, attrs); err != nil {
+			return err
+		}
+		return idx.inIdx.UpsertVectorContext(ctx, vec, uri, attrs)
+	})
+}
+
+func (idx *PersistentIndex) UpsertImage(img image.Image, uri string, attrs interface{}) (embedders.Vector, error) {
+	return idx.UpsertImageContext(context.Background(), img, uri, attrs)
+}
+
+func (idx *PersistentIndex) UpsertImageContext(ctx context.Context, img image.Image, uri string, attrs interface{}) (
+	embedders.Vector, error) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	oldVec, oldAttrs, existed := idx.inIdx.Get(uri)
+	vec, err := idx.inIdx.UpsertImageContext(ctx, img, uri, attrs)
+	if err != nil {
+		return nil, err
+	}
+	err = idx.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return upsertEmbed(tx, vec, uri, attrs)
+	})
+	if err != nil {
+		// Revert the in-memory index, so it remains consistent with the DB
+		if existed {
+			_ = idx.inIdx.UpsertVector(oldVec, uri, oldAttrs)
+		} else {
+			_, _ = idx.inIdx.RemoveURI(uri)
+		}
+		return nil, err
+	}
+	return vec, nil
+}
+
+// upsertEmbed updates the vector and the attributes of the image in the DB,
+// or creates a new row if there is no image with the URI.
+func upsertEmbed(tx *gorm.DB, vec embedders.Vector, uri string, attrs interface{}) error {
+	embed := ImgEmbed{
+		URI:        uri,
+		Vector:     kdtree.Point(vec),
+		Attributes: attrs,
+	}
+	// Unscoped, so the row of an image soft-deleted by the earlier versions, which didn't delete the rows,
+	// is restored instead of violating the unique constraint
+	result := tx.Unscoped().Model(&ImgEmbed{}).Where("uri = ?", uri).
+		Select("Vector", "Attributes", "DeletedAt").Updates(&embed)
+	if result.Error == nil && result.RowsAffected == 0 {
+		result = tx.Create(&embed)
+	}
+	if result.Error != nil {
+		return fmt.Errorf("failed to save image embed to DB: %w", result.Error)
+	}
+	return nil
+}
+
+// Get is answered by the in-memory index, the DB is not queried.
+func (idx *PersistentIndex) Get(uri string) (embedders.Vector, interface{}, bool) {
+	return idx.inIdx.Get(uri)
+}
+
+// Contains is answered by the in-memory index, the DB is not queried.
+func (idx *PersistentIndex) Contains(uri string) bool { return idx.inIdx.Contains(uri) }
+
 func (idx *PersistentIndex) GetCount() int { return idx.inIdx.GetCount() }
 
+func (idx *PersistentIndex) Rebalance() { idx.inIdx.Rebalance() }
+
+func (idx *PersistentIndex) Stats() IndexStats { return idx.inIdx.Stats() }
+
 func NewPersistentIndex(dialector gorm.Dialector, idx Index) (*PersistentIndex, error) {
+	return NewPersistentIndexContext(context.Background(), dialector, idx)
+}
+
+// NewPersistentIndexContext is the same as NewPersistentIndex, but it gives up loading the index once ctx is done.
+func NewPersistentIndexContext(ctx context.Context, dialector gorm.Dialector, idx Index) (*PersistentIndex, error) {
 	db, err := gorm.Open(dialector, &gorm.Config{
 		//	Logger: logger.Default.LogMode(logger.Info),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect db: %w", err)
 	}
-	err = db.AutoMigrate(&ImgEmbed{})
+	err = db.WithContext(ctx).AutoMigrate(&ImgEmbed{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to migrate db: %w", err)
 	}
 
 	embeds := make(embeds, 0)
-	result := db.Find(&embeds)
+	result := db.WithContext(ctx).Find(&embeds)
 	if result.Error != nil {
 		return nil, fmt.Errorf("failed to load data from db: %w", result.Error)
 	}
-	for _, embd := range embeds {
-		err := idx.AddVector(embedders.Vector(embd.Vector), embd.URI, embd.Attributes)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load vectors to index: %w", err)
-		}
+	if err := idx.AddVectorsContext(ctx, embeds); err != nil {
+		return nil, fmt.Errorf("failed to load vectors to index: %w", err)
 	}
 	return &PersistentIndex{db: db, inIdx: idx}, nil
 }
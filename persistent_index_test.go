@@ -1,11 +1,15 @@
 package imgidx_test
 
 import (
+	"context"
 	"github.com/alef-ru/imgidx"
 	"github.com/alef-ru/imgidx/embedders"
 	"github.com/stretchr/testify/assert"
+	"gonum.org/v1/gonum/spatial/kdtree"
 	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -110,3 +114,199 @@ func TestPersistentIndexRemoveNothing(t *testing.T) {
 	assert.Equal(t, 0, len(removed))
 	assert.Equal(t, cnt, idx.GetCount())
 }
+
+func TestPersistentIndexRemoveURI(t *testing.T) {
+	const pathToDB = "tmp_remove_uri.db"
+	t.Cleanup(func() {
+		_ = os.Remove(pathToDB)
+	})
+	idx, err := imgidx.NewPersistentIndex(sqlite.Open(pathToDB), newKD3Index(t))
+	assert.NoError(t, err, "Failed to create PersistentIndex")
+	vec := make(embedders.Vector, newEmbedder().Dims())
+	assert.NoError(t, idx.AddVector(vec, "a.png", "a"))
+	assert.NoError(t, idx.AddVector(vec, "b.png", "b"))
+
+	got, attrs, ok := idx.Get("a.png")
+	assert.True(t, ok)
+	assert.Equal(t, vec, got)
+	assert.Equal(t, "a", attrs)
+
+	removed, err := idx.RemoveURI("a.png", "c.png")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.png"}, removed)
+	assert.False(t, idx.Contains("a.png"))
+	assert.True(t, idx.Contains("b.png"))
+
+	// Reload the index and check that the image was removed from the DB
+	idx, err = imgidx.NewPersistentIndex(sqlite.Open(pathToDB), newKD3Index(t))
+	assert.NoError(t, err, "Failed to create PersistentIndex with existing SQLite file")
+	assert.Equal(t, 1, idx.GetCount())
+	assert.False(t, idx.Contains("a.png"))
+	assert.True(t, idx.Contains("b.png"))
+}
+
+func TestPersistentIndexReAddRemoved(t *testing.T) {
+	const pathToDB = "tmp_readd.db"
+	t.Cleanup(func() {
+		_ = os.Remove(pathToDB)
+	})
+	idx, err := imgidx.NewPersistentIndex(sqlite.Open(pathToDB), newKD3Index(t))
+	assert.NoError(t, err, "Failed to create PersistentIndex")
+	abra, err := loadImage("testdata/pokemon/abra.png")
+	assert.NoError(t, err)
+	vec := make(embedders.Vector, newEmbedder().Dims())
+
+	assert.NoError(t, idx.AddVector(vec, "a.png", "a"))
+	_, err = idx.RemoveURI("a.png")
+	assert.NoError(t, err)
+	assert.NoError(t, idx.AddVector(vec, "a.png", "a again"))
+
+	_, err = idx.AddImage(abra, "b.png", "b")
+	assert.NoError(t, err)
+	_, err = idx.Remove(func(vec embedders.Vector, uri string, attrs interface{}) bool { return uri == "b.png" })
+	assert.NoError(t, err)
+	_, err = idx.AddImage(abra, "b.png", "b again")
+	assert.NoError(t, err)
+
+	_, err = idx.RemoveURI("a.png", "b.png")
+	assert.NoError(t, err)
+	_, err = idx.AddImages([]imgidx.ImageItem{
+		{Image: abra, URI: "a.png", Attributes: "a batch"},
+		{Image: abra, URI: "b.png", Attributes: "b batch"},
+	})
+	assert.NoError(t, err)
+
+	// Reload the index and check that the re-added images are persisted once
+	idx, err = imgidx.NewPersistentIndex(sqlite.Open(pathToDB), newKD3Index(t))
+	assert.NoError(t, err, "Failed to create PersistentIndex with existing SQLite file")
+	assert.Equal(t, 2, idx.GetCount())
+	_, attrs, _ := idx.Get("a.png")
+	assert.Equal(t, "a batch", attrs)
+	_, attrs, _ = idx.Get("b.png")
+	assert.Equal(t, "b batch", attrs)
+}
+
+func TestPersistentIndexUpsertSoftDeletedRow(t *testing.T) {
+	// The DBs written by the versions that soft-deleted the removed images still have their rows
+	const pathToDB = "tmp_soft_deleted.db"
+	t.Cleanup(func() {
+		_ = os.Remove(pathToDB)
+	})
+	db, err := gorm.Open(sqlite.Open(pathToDB), &gorm.Config{})
+	assert.NoError(t, err)
+	assert.NoError(t, db.AutoMigrate(&imgidx.ImgEmbed{}))
+	vec := make(embedders.Vector, newEmbedder().Dims())
+	assert.NoError(t, db.Create(&imgidx.ImgEmbed{URI: "a.png", Vector: kdtree.Point(vec)}).Error)
+	assert.NoError(t, db.Where("uri = ?", "a.png").Delete(&imgidx.ImgEmbed{}).Error)
+	sqlDB, err := db.DB()
+	assert.NoError(t, err)
+	assert.NoError(t, sqlDB.Close())
+
+	idx, err := imgidx.NewPersistentIndex(sqlite.Open(pathToDB), newKD3Index(t))
+	assert.NoError(t, err, "Failed to create PersistentIndex with existing SQLite file")
+	assert.Equal(t, 0, idx.GetCount())
+	assert.NoError(t, idx.UpsertVector(vec, "a.png", "restored"))
+
+	idx, err = imgidx.NewPersistentIndex(sqlite.Open(pathToDB), newKD3Index(t))
+	assert.NoError(t, err, "Failed to create PersistentIndex with existing SQLite file")
+	_, attrs, ok := idx.Get("a.png")
+	assert.True(t, ok)
+	assert.Equal(t, "restored", attrs)
+}
+
+func TestPersistentIndexUpdateAndUpsert(t *testing.T) {
+	const pathToDB = "tmp_upsert.db"
+	t.Cleanup(func() {
+		_ = os.Remove(pathToDB)
+	})
+	idx, err := imgidx.NewPersistentIndex(sqlite.Open(pathToDB), newKD3Index(t))
+	assert.NoError(t, err, "Failed to create PersistentIndex")
+	addPokemonsToIndex(t, idx)
+	cnt := idx.GetCount()
+	abra, err := loadImage("testdata/pokemon/abra.png")
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, idx.UpdateAttributes("unknown.png", "a"), imgidx.ErrNotFound)
+	absolPath, err := filepath.Abs("testdata/pokemon/absol.png")
+	assert.NoError(t, err)
+	absolURI := "file://" + absolPath
+	assert.NoError(t, idx.UpdateAttributes(absolURI, "updated absol"))
+	// Replace absol.png's vector with abra's one
+	vec, err := idx.UpsertImage(abra, absolURI, "abra in absol's place")
+	assert.NoError(t, err)
+	// Add a new image with upsert
+	_, err = idx.UpsertImage(abra, "new.png", "new abra")
+	assert.NoError(t, err)
+	// Upsert an image that was removed before
+	_, err = idx.RemoveURI("new.png")
+	assert.NoError(t, err)
+	_, err = idx.UpsertImage(abra, "new.png", "restored abra")
+	assert.NoError(t, err)
+	assert.Equal(t, cnt+1, idx.GetCount())
+
+	// Reload the index and check that the changes are persisted
+	idx, err = imgidx.NewPersistentIndex(sqlite.Open(pathToDB), newKD3Index(t))
+	assert.NoError(t, err, "Failed to create PersistentIndex with existing SQLite file")
+	assert.Equal(t, cnt+1, idx.GetCount())
+	got, attrs, ok := idx.Get(absolURI)
+	assert.True(t, ok)
+	assert.Equal(t, vec, got)
+	assert.Equal(t, "abra in absol's place", attrs)
+	_, attrs, _ = idx.Get("new.png")
+	assert.Equal(t, "restored abra", attrs)
+}
+
+func TestPersistentIndexAddImages(t *testing.T) {
+	const pathToDB = "tmp_batch.db"
+	t.Cleanup(func() {
+		_ = os.Remove(pathToDB)
+	})
+	items := loadPokemonItems(t)
+	idx, err := imgidx.NewPersistentIndex(sqlite.Open(pathToDB), newKD3Index(t))
+	assert.NoError(t, err, "Failed to create PersistentIndex")
+	_, err = idx.AddImages(items[1:])
+	assert.NoError(t, err, "Failed to add images")
+	assert.Equal(t, len(items)-1, idx.GetCount())
+
+	vec := make([]float64, newEmbedder().Dims())
+	assert.NoError(t, idx.AddVectors([]imgidx.ImgEmbed{{URI: "a.png", Vector: vec}, {URI: "b.png", Vector: vec}}))
+	err = idx.AddVectors([]imgidx.ImgEmbed{{URI: "c.png", Vector: vec}, {URI: "a.png", Vector: vec}})
+	assert.ErrorContains(t, err, "UNIQUE constraint failed")
+	assert.False(t, idx.Contains("c.png"), "None of the vectors was expected to be added")
+
+	// Reload the index, it's supposed to contain the same images
+	idx, err = imgidx.NewPersistentIndex(sqlite.Open(pathToDB), newKD3Index(t))
+	assert.NoError(t, err, "Failed to create PersistentIndex with existing SQLite file")
+	assert.Equal(t, len(items)+1, idx.GetCount())
+	assert.False(t, idx.Contains(items[0].URI))
+	assert.True(t, idx.Contains(items[1].URI))
+	assert.True(t, idx.Contains("a.png"))
+	assert.False(t, idx.Contains("c.png"))
+
+	// If the DB fails, the in-memory index is reverted
+	assert.NoError(t, os.Remove(pathToDB))
+	_, err = idx.AddImages(items[:1])
+	assert.ErrorContains(t, err, "failed to save image embeds to DB")
+	assert.False(t, idx.Contains(items[0].URI))
+	assert.Equal(t, len(items)+1, idx.GetCount())
+}
+
+func TestPersistentIndexContextCancelled(t *testing.T) {
+	idx := makeTestPersistentIndex(t)
+	vec := make(embedders.Vector, newEmbedder().Dims())
+	assert.NoError(t, idx.AddVector(vec, "a.png", "a"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.ErrorIs(t, idx.AddVectorContext(ctx, vec, "b.png", nil), context.Canceled)
+	assert.ErrorIs(t, idx.UpdateAttributesContext(ctx, "a.png", "new"), context.Canceled)
+	_, err := idx.RemoveURIContext(ctx, "a.png")
+	assert.ErrorIs(t, err, context.Canceled)
+	_, attrs, ok := idx.Get("a.png")
+	assert.True(t, ok)
+	assert.Equal(t, "a", attrs)
+	assert.False(t, idx.Contains("b.png"))
+
+	_, err = imgidx.NewPersistentIndexContext(ctx, sqlite.Open("tmp_test.db"), newKD3Index(t))
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,92 @@
+package imgidx
+
+// minOverlaySize is the size the overlay of uriMap may always grow to without merging into the base map
+const minOverlaySize = 64
+
+// uriMap is an immutable map of images by their URIs.
+//
+// Changing the map produces a new one that shares data with the original. The changes are accumulated
+// in a small overlay, which is copied on every change and merged into the base map once it grows bigger
+// than the square root of the map size. So a change costs O(sqrt(n)) on average instead of copying the whole map.
+type uriMap struct {
+	base map[string]ImgEmbed
+	// overlay takes precedence over base. Nil values mark the images removed from base.
+	overlay map[string]*ImgEmbed
+	size    int
+}
+
+func newURIMap(embds []ImgEmbed) *uriMap {
+	base := make(map[string]ImgEmbed, len(embds))
+	for _, embd := range embds {
+		base[embd.URI] = embd
+	}
+	return &uriMap{base: base, size: len(base)}
+}
+
+func (m *uriMap) get(uri string) (ImgEmbed, bool) {
+	if embd, ok := m.overlay[uri]; ok {
+		if embd == nil {
+			return ImgEmbed{}, false
+		}
+		return *embd, true
+	}
+	embd, ok := m.base[uri]
+	return embd, ok
+}
+
+func (m *uriMap) len() int { return m.size }
+
+// each calls f for every image in the map, in no particular order, until f returns false
+func (m *uriMap) each(f func(embd ImgEmbed) bool) {
+	for uri, embd := range m.base {
+		if _, ok := m.overlay[uri]; !ok && !f(embd) {
+			return
+		}
+	}
+	for _, embd := range m.overlay {
+		if embd != nil && !f(*embd) {
+			return
+		}
+	}
+}
+
+// values returns all the images in the map
+func (m *uriMap) values() embeds {
+	values := make(embeds, 0, m.size)
+	m.each(func(embd ImgEmbed) bool {
+		values = append(values, embd)
+		return true
+	})
+	return values
+}
+
+// with returns a copy of the map with the changes applied, the receiver remains intact.
+// The changes are images by their URIs, nil removes the image with the URI.
+func (m *uriMap) with(changes map[string]*ImgEmbed) *uriMap {
+	res := &uriMap{
+		base:    m.base,
+		overlay: make(map[string]*ImgEmbed, len(m.overlay)+len(changes)),
+		size:    m.size,
+	}
+	for uri, embd := range m.overlay {
+		res.overlay[uri] = embd
+	}
+	for uri, embd := range changes {
+		_, existed := m.get(uri)
+		switch {
+		case embd == nil && existed:
+			res.size--
+		case embd != nil && !existed:
+			res.size++
+		}
+		if _, inBase := m.base[uri]; embd == nil && !inBase {
+			delete(res.overlay, uri)
+		} else {
+			res.overlay[uri] = embd
+		}
+	}
+	if len(res.overlay) > minOverlaySize && len(res.overlay)*len(res.overlay) > res.size {
+		return newURIMap(res.values())
+	}
+	return res
+}